@@ -17,73 +17,98 @@ package ecr
 
 import (
 	"context"
-	"errors"
-	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-var (
-	errImageNotFound = errors.New("ecr: image not found")
-)
+// supportedImageMediaTypes lists the manifest media types that are requested
+// from Amazon ECR.  Image indexes and manifest lists are included so that
+// multi-platform images resolve to the index rather than to a single platform.
+var supportedImageMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	images.MediaTypeDockerSchema2Manifest,
+	ocispec.MediaTypeImageIndex,
+	images.MediaTypeDockerSchema2ManifestList,
+}
 
 type ecrBase struct {
-	client  ecrAPI
+	client  ECRClient
 	ecrSpec ECRSpec
 }
 
-// ecrAPI contains only the ECR APIs that are called by the resolver
+// ECRClient contains only the ECR APIs that are called by the resolver.  It is
+// implemented by the *ecr.ECR client of the AWS SDK, and other
+// implementations, such as fakes, caching decorators, or instrumented clients,
+// can be used with WithClientFactory.
 // See https://docs.aws.amazon.com/sdk-for-go/api/service/ecr/ecriface/ for the
 // full interface from the SDK.
-type ecrAPI interface {
+type ECRClient interface {
 	BatchGetImageWithContext(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
 	GetDownloadUrlForLayerWithContext(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
 	BatchCheckLayerAvailabilityWithContext(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
-	InitiateLayerUpload(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
-	UploadLayerPart(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
-	CompleteLayerUpload(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
+	InitiateLayerUploadWithContext(aws.Context, *ecr.InitiateLayerUploadInput, ...request.Option) (*ecr.InitiateLayerUploadOutput, error)
+	UploadLayerPartWithContext(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error)
+	CompleteLayerUploadWithContext(aws.Context, *ecr.CompleteLayerUploadInput, ...request.Option) (*ecr.CompleteLayerUploadOutput, error)
 	PutImageWithContext(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	DescribeImagesWithContext(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
 }
 
+var _ ECRClient = (*ecr.ECR)(nil)
+
+// getManifest retrieves the image identified by the ref.
 func (b *ecrBase) getManifest(ctx context.Context) (*ecr.Image, error) {
-	imageIdentifier := b.ecrSpec.ImageID()
+	return b.getImage(ctx, b.ecrSpec.ImageID())
+}
+
+// getImage retrieves the image with the given identifier from the ref's
+// repository.  Manifests with one of the supportedImageMediaTypes or one of the
+// additional media types are accepted.
+func (b *ecrBase) getImage(ctx context.Context, imageIdentifier *ecr.ImageIdentifier, additionalMediaTypes ...string) (*ecr.Image, error) {
 	log.G(ctx).WithField("imageIdentifier", imageIdentifier).Debug("ecr.base.manifest")
+	acceptedMediaTypes := append([]string(nil), supportedImageMediaTypes...)
+	for _, mediaType := range additionalMediaTypes {
+		if !containsString(acceptedMediaTypes, mediaType) {
+			acceptedMediaTypes = append(acceptedMediaTypes, mediaType)
+		}
+	}
 	batchGetImageInput := &ecr.BatchGetImageInput{
-		RegistryId:     aws.String(b.ecrSpec.Registry()),
-		RepositoryName: aws.String(b.ecrSpec.Repository),
-		ImageIds:       []*ecr.ImageIdentifier{imageIdentifier},
-		// TODO: Determine if this should be hard-coded
-		AcceptedMediaTypes: []*string{
-			aws.String(ocispec.MediaTypeImageManifest),
-			aws.String(images.MediaTypeDockerSchema2Manifest),
-		},
+		RegistryId:         aws.String(b.ecrSpec.Registry()),
+		RepositoryName:     aws.String(b.ecrSpec.Repository),
+		ImageIds:           []*ecr.ImageIdentifier{imageIdentifier},
+		AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes),
 	}
 
 	batchGetImageOutput, err := b.client.BatchGetImageWithContext(ctx, batchGetImageInput)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("ecr.base.manifest: failed to get image")
-		fmt.Println(err)
-		return nil, err
+		return nil, ecrerr.FromAWSError("BatchGetImage", err)
 	}
 	log.G(ctx).WithField("batchGetImage", batchGetImageOutput).Debug("ecr.base.manifest")
 
 	var ecrImage *ecr.Image
 	if len(batchGetImageOutput.Images) == 0 {
-		if len(batchGetImageOutput.Failures) > 0 &&
-			aws.StringValue(batchGetImageOutput.Failures[0].FailureCode) == ecr.ImageFailureCodeImageNotFound {
-			return nil, errImageNotFound
+		if len(batchGetImageOutput.Failures) > 0 {
+			return nil, ecrerr.FromImageFailure("BatchGetImage", batchGetImageOutput.Failures[0])
 		}
-		log.G(ctx).
-			WithField("failures", batchGetImageOutput.Failures).
-			Warn("ecr.base.manifest: unexpected failure")
+		log.G(ctx).Warn("ecr.base.manifest: no image or failure returned")
 		return nil, reference.ErrInvalid
 	}
 	ecrImage = batchGetImageOutput.Images[0]
 	return ecrImage, nil
 }
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -27,6 +27,18 @@
 // of the repository and a label and/or a digest.  Valid references are of the
 // form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
 //
+// Errors
+//
+// Failures from the Amazon ECR API are returned as *ecrerr.Error values, which
+// classify the failure using containerd's errdefs package.  Callers can use
+// errdefs.IsNotFound, errdefs.IsAlreadyExists, and the other errdefs
+// predicates on errors returned from the Resolver, Fetcher, and Pusher; these
+// work with every Go version supported by this module.  Only when built with
+// Go 1.13 or later can errors.Is from the standard library also be used, for
+// example errors.Is(err, errdefs.ErrNotFound), as errors wrapped by this
+// package support Unwrap.  Go 1.12 has no errors.Is, so code that must build
+// with it should keep to the errdefs predicates.
+//
 // License
 //
 // This package is licensed under the Apache 2.0 license.
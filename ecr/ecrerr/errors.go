@@ -0,0 +1,240 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+// Package ecrerr classifies failures returned by the Amazon ECR API using the
+// error types defined by containerd's errdefs package.
+//
+// Errors returned from this package can be inspected with the errdefs
+// predicates (for example errdefs.IsNotFound), with errors.Cause from
+// github.com/pkg/errors, and with errors.Is from the standard library.  The
+// original error returned by the AWS SDK remains available through
+// errors.Unwrap and errors.As.
+package ecrerr
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+// ErrAccessDenied is the class of errors caused by the caller not being
+// authorized to perform an operation.  containerd does not define an
+// equivalent error type.
+var ErrAccessDenied = errors.New("access denied")
+
+// Error is a classified failure from the Amazon ECR API.
+type Error struct {
+	// Op is the name of the Amazon ECR API operation that failed.
+	Op string
+	// Code is the error code or failure code returned by Amazon ECR.
+	Code string
+	// Message is the message returned by Amazon ECR, if any.
+	Message string
+	// Class is the errdefs error (or ErrAccessDenied) that the failure
+	// belongs to.
+	Class error
+	// Err is the underlying error returned by the AWS SDK, if any.  It is nil
+	// for failures reported in the body of a successful response.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := "ecr: " + e.Op + ": " + e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Cause returns the class of the error so that errors.Cause and the errdefs
+// predicates can be used.
+func (e *Error) Cause() error {
+	return e.Class
+}
+
+// Is reports whether target is the class of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Class
+}
+
+// Unwrap returns the underlying error returned by the AWS SDK.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorCodeClasses maps error codes returned by the Amazon ECR API, along with
+// common AWS error codes, to their class.
+var errorCodeClasses = map[string]error{
+	ecr.ErrCodeRepositoryNotFoundException:       errdefs.ErrNotFound,
+	ecr.ErrCodeImageNotFoundException:            errdefs.ErrNotFound,
+	ecr.ErrCodeLayersNotFoundException:           errdefs.ErrNotFound,
+	ecr.ErrCodeUploadNotFoundException:           errdefs.ErrNotFound,
+	ecr.ErrCodeRepositoryPolicyNotFoundException: errdefs.ErrNotFound,
+	ecr.ErrCodeLifecyclePolicyNotFoundException:  errdefs.ErrNotFound,
+	ecr.ErrCodeScanNotFoundException:             errdefs.ErrNotFound,
+
+	ecr.ErrCodeLayerAlreadyExistsException:      errdefs.ErrAlreadyExists,
+	ecr.ErrCodeImageAlreadyExistsException:      errdefs.ErrAlreadyExists,
+	ecr.ErrCodeImageTagAlreadyExistsException:   errdefs.ErrAlreadyExists,
+	ecr.ErrCodeRepositoryAlreadyExistsException: errdefs.ErrAlreadyExists,
+
+	ecr.ErrCodeInvalidParameterException:    errdefs.ErrInvalidArgument,
+	ecr.ErrCodeInvalidTagParameterException: errdefs.ErrInvalidArgument,
+	ecr.ErrCodeTooManyTagsException:         errdefs.ErrInvalidArgument,
+	ecr.ErrCodeLayerPartTooSmallException:   errdefs.ErrInvalidArgument,
+	"UnsupportedImageTypeException":         errdefs.ErrInvalidArgument,
+	"ValidationException":                   errdefs.ErrInvalidArgument,
+
+	ecr.ErrCodeInvalidLayerException:         errdefs.ErrFailedPrecondition,
+	ecr.ErrCodeInvalidLayerPartException:     errdefs.ErrFailedPrecondition,
+	ecr.ErrCodeEmptyUploadException:          errdefs.ErrFailedPrecondition,
+	ecr.ErrCodeLimitExceededException:        errdefs.ErrFailedPrecondition,
+	ecr.ErrCodeRepositoryNotEmptyException:   errdefs.ErrFailedPrecondition,
+	"ImageDigestDoesNotMatchException":       errdefs.ErrFailedPrecondition,
+	"ReferencedImagesNotFoundException":      errdefs.ErrFailedPrecondition,
+	ecr.ErrCodeLayerInaccessibleException:    errdefs.ErrUnavailable,
+	ecr.ErrCodeServerException:               errdefs.ErrUnavailable,
+	"KmsException":                           errdefs.ErrUnavailable,
+	"ThrottlingException":                    errdefs.ErrUnavailable,
+	"Throttling":                             errdefs.ErrUnavailable,
+	"ThrottledException":                     errdefs.ErrUnavailable,
+	"RequestThrottled":                       errdefs.ErrUnavailable,
+	"RequestThrottledException":              errdefs.ErrUnavailable,
+	"RequestLimitExceeded":                   errdefs.ErrUnavailable,
+	"TooManyRequestsException":               errdefs.ErrUnavailable,
+	"ProvisionedThroughputExceededException": errdefs.ErrUnavailable,
+	"SlowDown":                               errdefs.ErrUnavailable,
+	"ServiceUnavailable":                     errdefs.ErrUnavailable,
+	"ServiceUnavailableException":            errdefs.ErrUnavailable,
+	"InternalFailure":                        errdefs.ErrUnavailable,
+	"InternalError":                          errdefs.ErrUnavailable,
+	"RequestTimeout":                         errdefs.ErrUnavailable,
+	"RequestTimeoutException":                errdefs.ErrUnavailable,
+	"RequestError":                           errdefs.ErrUnavailable,
+
+	"AccessDeniedException":       ErrAccessDenied,
+	"AccessDenied":                ErrAccessDenied,
+	"UnrecognizedClientException": ErrAccessDenied,
+	"InvalidSignatureException":   ErrAccessDenied,
+	"IncompleteSignature":         ErrAccessDenied,
+	"MissingAuthenticationToken":  ErrAccessDenied,
+	"ExpiredTokenException":       ErrAccessDenied,
+	"ExpiredToken":                ErrAccessDenied,
+	"NoCredentialProviders":       ErrAccessDenied,
+}
+
+// imageFailureClasses maps the failure codes reported by BatchGetImage to
+// their class.
+var imageFailureClasses = map[string]error{
+	ecr.ImageFailureCodeImageNotFound:              errdefs.ErrNotFound,
+	ecr.ImageFailureCodeInvalidImageDigest:         errdefs.ErrInvalidArgument,
+	ecr.ImageFailureCodeInvalidImageTag:            errdefs.ErrInvalidArgument,
+	ecr.ImageFailureCodeMissingDigestAndTag:        errdefs.ErrInvalidArgument,
+	ecr.ImageFailureCodeImageTagDoesNotMatchDigest: errdefs.ErrFailedPrecondition,
+	"ImageReferencedByManifestList":                errdefs.ErrFailedPrecondition,
+	"KmsError":                                     errdefs.ErrUnavailable,
+	"UpstreamAccessDenied":                         ErrAccessDenied,
+	"UpstreamTooManyRequests":                      errdefs.ErrUnavailable,
+	"UpstreamUnavailable":                          errdefs.ErrUnavailable,
+}
+
+// layerFailureClasses maps the failure codes reported by
+// BatchCheckLayerAvailability to their class.
+var layerFailureClasses = map[string]error{
+	ecr.LayerFailureCodeMissingLayerDigest: errdefs.ErrNotFound,
+	ecr.LayerFailureCodeInvalidLayerDigest: errdefs.ErrInvalidArgument,
+}
+
+// FromAWSError classifies an error returned by the AWS SDK while calling the
+// Amazon ECR API operation op.  Errors that did not originate from the AWS SDK
+// are returned unmodified.
+func FromAWSError(op string, err error) error {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	class, ok := errorCodeClasses[awsErr.Code()]
+	if !ok {
+		class = statusCodeClass(err)
+	}
+	return &Error{
+		Op:      op,
+		Code:    awsErr.Code(),
+		Message: awsErr.Message(),
+		Class:   class,
+		Err:     err,
+	}
+}
+
+// statusCodeClass classifies an error by its HTTP status code when the error
+// code is not known.
+func statusCodeClass(err error) error {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		return errdefs.ErrUnknown
+	}
+	switch status := reqErr.StatusCode(); {
+	case status == http.StatusNotFound:
+		return errdefs.ErrNotFound
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return ErrAccessDenied
+	case status == http.StatusTooManyRequests, status >= http.StatusInternalServerError:
+		return errdefs.ErrUnavailable
+	case status >= http.StatusBadRequest:
+		return errdefs.ErrInvalidArgument
+	}
+	return errdefs.ErrUnknown
+}
+
+// FromImageFailure classifies a failure reported by BatchGetImage.
+func FromImageFailure(op string, failure *ecr.ImageFailure) error {
+	code := aws.StringValue(failure.FailureCode)
+	class, ok := imageFailureClasses[code]
+	if !ok {
+		class = errdefs.ErrUnknown
+	}
+	return &Error{
+		Op:      op,
+		Code:    code,
+		Message: aws.StringValue(failure.FailureReason),
+		Class:   class,
+	}
+}
+
+// FromLayerFailure classifies a failure reported by
+// BatchCheckLayerAvailability.
+func FromLayerFailure(op string, failure *ecr.LayerFailure) error {
+	code := aws.StringValue(failure.FailureCode)
+	class, ok := layerFailureClasses[code]
+	if !ok {
+		class = errdefs.ErrUnknown
+	}
+	return &Error{
+		Op:      op,
+		Code:    code,
+		Message: aws.StringValue(failure.FailureReason),
+		Class:   class,
+	}
+}
+
+// IsAccessDenied returns true if the error is due to the caller not being
+// authorized to perform an operation.
+func IsAccessDenied(err error) bool {
+	return errors.Cause(err) == ErrAccessDenied
+}
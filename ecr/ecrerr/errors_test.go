@@ -0,0 +1,159 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecrerr
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromAWSError(t *testing.T) {
+	cases := []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{
+			name:  "repository not found",
+			err:   awserr.New(ecr.ErrCodeRepositoryNotFoundException, "", nil),
+			class: errdefs.ErrNotFound,
+		},
+		{
+			name:  "image not found",
+			err:   awserr.New(ecr.ErrCodeImageNotFoundException, "", nil),
+			class: errdefs.ErrNotFound,
+		},
+		{
+			name:  "layer already exists",
+			err:   awserr.New(ecr.ErrCodeLayerAlreadyExistsException, "", nil),
+			class: errdefs.ErrAlreadyExists,
+		},
+		{
+			name:  "invalid parameter",
+			err:   awserr.New(ecr.ErrCodeInvalidParameterException, "", nil),
+			class: errdefs.ErrInvalidArgument,
+		},
+		{
+			name:  "invalid layer",
+			err:   awserr.New(ecr.ErrCodeInvalidLayerException, "", nil),
+			class: errdefs.ErrFailedPrecondition,
+		},
+		{
+			name:  "throttled",
+			err:   awserr.New("ThrottlingException", "", nil),
+			class: errdefs.ErrUnavailable,
+		},
+		{
+			name:  "server error",
+			err:   awserr.New(ecr.ErrCodeServerException, "", nil),
+			class: errdefs.ErrUnavailable,
+		},
+		{
+			name:  "access denied",
+			err:   awserr.New("AccessDeniedException", "", nil),
+			class: ErrAccessDenied,
+		},
+		{
+			name:  "unknown code",
+			err:   awserr.New("SomethingNew", "", nil),
+			class: errdefs.ErrUnknown,
+		},
+		{
+			name:  "unknown code with status",
+			err:   awserr.NewRequestFailure(awserr.New("SomethingNew", "", nil), http.StatusServiceUnavailable, ""),
+			class: errdefs.ErrUnavailable,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := FromAWSError("Op", tc.err)
+			require.Error(t, err)
+			assert.Equal(t, tc.class, errors.Cause(err))
+			ecrErr, ok := err.(*Error)
+			require.True(t, ok, "error should be an Error")
+			assert.True(t, ecrErr.Is(tc.class))
+			assert.Equal(t, "Op", ecrErr.Op)
+			assert.Equal(t, tc.err, ecrErr.Unwrap())
+		})
+	}
+}
+
+func TestFromAWSErrorPassthrough(t *testing.T) {
+	assert.Nil(t, FromAWSError("Op", nil))
+	err := errors.New("not from the SDK")
+	assert.Equal(t, err, FromAWSError("Op", err))
+}
+
+func TestFromAWSErrorPredicates(t *testing.T) {
+	err := errors.Wrap(FromAWSError("Op", awserr.New(ecr.ErrCodeRepositoryNotFoundException, "", nil)), "wrapped")
+	assert.True(t, errdefs.IsNotFound(err))
+	assert.False(t, errdefs.IsAlreadyExists(err))
+
+	err = FromAWSError("Op", awserr.New("AccessDeniedException", "", nil))
+	assert.True(t, IsAccessDenied(err))
+	assert.False(t, errdefs.IsNotFound(err))
+}
+
+func TestFromImageFailure(t *testing.T) {
+	cases := []struct {
+		code  string
+		class error
+	}{
+		{ecr.ImageFailureCodeImageNotFound, errdefs.ErrNotFound},
+		{ecr.ImageFailureCodeInvalidImageDigest, errdefs.ErrInvalidArgument},
+		{ecr.ImageFailureCodeInvalidImageTag, errdefs.ErrInvalidArgument},
+		{ecr.ImageFailureCodeMissingDigestAndTag, errdefs.ErrInvalidArgument},
+		{ecr.ImageFailureCodeImageTagDoesNotMatchDigest, errdefs.ErrFailedPrecondition},
+		{"", errdefs.ErrUnknown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.code, func(t *testing.T) {
+			err := FromImageFailure("BatchGetImage", &ecr.ImageFailure{
+				FailureCode:   aws.String(tc.code),
+				FailureReason: aws.String("reason"),
+			})
+			assert.Equal(t, tc.class, errors.Cause(err))
+			assert.EqualError(t, err, "ecr: BatchGetImage: "+tc.code+": reason")
+		})
+	}
+}
+
+func TestFromLayerFailure(t *testing.T) {
+	cases := []struct {
+		code  string
+		class error
+	}{
+		{ecr.LayerFailureCodeMissingLayerDigest, errdefs.ErrNotFound},
+		{ecr.LayerFailureCodeInvalidLayerDigest, errdefs.ErrInvalidArgument},
+		{"", errdefs.ErrUnknown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.code, func(t *testing.T) {
+			err := FromLayerFailure("BatchCheckLayerAvailability", &ecr.LayerFailure{
+				FailureCode: aws.String(tc.code),
+			})
+			assert.Equal(t, tc.class, errors.Cause(err))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+const defaultDNSSuffix = "amazonaws.com"
+
+// dualStackDNSSuffixes maps partitions to the DNS suffixes of their
+// dual-stack registry and API endpoints.
+var dualStackDNSSuffixes = map[string]struct{ registry, api string }{
+	"aws":        {"on.aws", "api.aws"},
+	"aws-us-gov": {"on.aws", "api.aws"},
+	"aws-cn":     {"on.amazonwebservices.com.cn", "api.amazonwebservices.com.cn"},
+}
+
+// EndpointFunc returns the URL of the Amazon ECR API endpoint to use for the
+// registry of ecrSpec, or "" to use the endpoint the resolver would use by
+// default.
+type EndpointFunc func(ecrSpec ECRSpec) string
+
+// ecrEndpoint describes the variant of the Amazon ECR endpoint named by the
+// hostname of an image URI.
+type ecrEndpoint struct {
+	fips        bool
+	dualStack   bool
+	vpcEndpoint string
+}
+
+// FIPS reports whether the reference names a FIPS endpoint, such as
+// "<account>.dkr.ecr-fips.<region>.amazonaws.com".
+func (spec ECRSpec) FIPS() bool {
+	return spec.endpoint.fips
+}
+
+// DualStack reports whether the reference names a dual-stack endpoint, such
+// as "<account>.dkr-ecr.<region>.on.aws".
+func (spec ECRSpec) DualStack() bool {
+	return spec.endpoint.dualStack
+}
+
+// VPCEndpoint returns the ID of the interface VPC endpoint named by the
+// reference, such as "vpce-0123456789abcdef0" for
+// "<account>.vpce-0123456789abcdef0.dkr.ecr.<region>.vpce.amazonaws.com", or
+// "" if the reference does not name a VPC endpoint.
+func (spec ECRSpec) VPCEndpoint() string {
+	return spec.endpoint.vpcEndpoint
+}
+
+// partitionByID returns the partition with the given ID.
+func partitionByID(id string) (endpoints.Partition, bool) {
+	for _, partition := range endpoints.DefaultPartitions() {
+		if partition.ID() == id {
+			return partition, true
+		}
+	}
+	return endpoints.Partition{}, false
+}
+
+// dnsSuffix returns the DNS suffix of the partition of the reference.
+func (spec ECRSpec) dnsSuffix() string {
+	if partition, ok := partitionByID(spec.Partition()); ok {
+		return partition.DNSSuffix()
+	}
+	return defaultDNSSuffix
+}
+
+// registryHost returns the hostname of the registry endpoint named by the
+// reference.
+func (spec ECRSpec) registryHost() string {
+	fips := ""
+	if spec.endpoint.fips {
+		fips = "-fips"
+	}
+	switch {
+	case spec.Public():
+		return publicRegistryHost
+	case spec.endpoint.vpcEndpoint != "":
+		return spec.Registry() + "." + spec.endpoint.vpcEndpoint + ".dkr.ecr." + spec.Region() + ".vpce." + spec.dnsSuffix()
+	case spec.endpoint.dualStack:
+		return spec.Registry() + ".dkr-ecr" + fips + "." + spec.Region() + "." + dualStackDNSSuffixes[spec.Partition()].registry
+	default:
+		return spec.Registry() + ".dkr.ecr" + fips + "." + spec.Region() + "." + spec.dnsSuffix()
+	}
+}
+
+// apiEndpoint returns the URL of the Amazon ECR API endpoint matching the
+// registry endpoint named by the reference, or "" to use the default
+// endpoint of the region.  Interface VPC endpoints for the registry and for
+// the API have different IDs, so the API endpoint cannot be derived from a
+// VPC endpoint reference; enabling private DNS on the API endpoint routes the
+// default endpoint through the VPC.
+func (spec ECRSpec) apiEndpoint() string {
+	fips := ""
+	if spec.endpoint.fips {
+		fips = "-fips"
+	}
+	switch {
+	case spec.endpoint.dualStack:
+		return "https://ecr" + fips + "." + spec.Region() + "." + dualStackDNSSuffixes[spec.Partition()].api
+	case spec.endpoint.fips:
+		return "https://ecr-fips." + spec.Region() + "." + spec.dnsSuffix()
+	default:
+		return ""
+	}
+}
@@ -21,20 +21,21 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 )
 
-// fakeECRClient is a fake that can be used for testing the ecrAPI interface.
+// fakeECRClient is a fake that can be used for testing the ECRClient interface.
 // Each method is backed by a function contained in the struct.  Nil functions
 // will cause panics when invoked.
 type fakeECRClient struct {
 	BatchGetImageFn               func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error)
 	GetDownloadUrlForLayerFn      func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error)
 	BatchCheckLayerAvailabilityFn func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error)
-	InitiateLayerUploadFn         func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error)
-	UploadLayerPartFn             func(*ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error)
-	CompleteLayerUploadFn         func(*ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error)
+	InitiateLayerUploadFn         func(aws.Context, *ecr.InitiateLayerUploadInput, ...request.Option) (*ecr.InitiateLayerUploadOutput, error)
+	UploadLayerPartFn             func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error)
+	CompleteLayerUploadFn         func(aws.Context, *ecr.CompleteLayerUploadInput, ...request.Option) (*ecr.CompleteLayerUploadOutput, error)
 	PutImageFn                    func(aws.Context, *ecr.PutImageInput, ...request.Option) (*ecr.PutImageOutput, error)
+	DescribeImagesFn              func(aws.Context, *ecr.DescribeImagesInput, ...request.Option) (*ecr.DescribeImagesOutput, error)
 }
 
-var _ ecrAPI = (*fakeECRClient)(nil)
+var _ ECRClient = (*fakeECRClient)(nil)
 
 func (f *fakeECRClient) BatchGetImageWithContext(ctx aws.Context, arg *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
 	return f.BatchGetImageFn(ctx, arg, opts...)
@@ -48,18 +49,22 @@ func (f *fakeECRClient) BatchCheckLayerAvailabilityWithContext(ctx aws.Context,
 	return f.BatchCheckLayerAvailabilityFn(ctx, arg, opts...)
 }
 
-func (f *fakeECRClient) InitiateLayerUpload(arg *ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
-	return f.InitiateLayerUploadFn(arg)
+func (f *fakeECRClient) InitiateLayerUploadWithContext(ctx aws.Context, arg *ecr.InitiateLayerUploadInput, opts ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+	return f.InitiateLayerUploadFn(ctx, arg, opts...)
 }
 
-func (f *fakeECRClient) UploadLayerPart(arg *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
-	return f.UploadLayerPartFn(arg)
+func (f *fakeECRClient) UploadLayerPartWithContext(ctx aws.Context, arg *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+	return f.UploadLayerPartFn(ctx, arg, opts...)
 }
 
-func (f *fakeECRClient) CompleteLayerUpload(arg *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
-	return f.CompleteLayerUploadFn(arg)
+func (f *fakeECRClient) CompleteLayerUploadWithContext(ctx aws.Context, arg *ecr.CompleteLayerUploadInput, opts ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+	return f.CompleteLayerUploadFn(ctx, arg, opts...)
 }
 
 func (f *fakeECRClient) PutImageWithContext(ctx aws.Context, arg *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
 	return f.PutImageFn(ctx, arg, opts...)
 }
+
+func (f *fakeECRClient) DescribeImagesWithContext(ctx aws.Context, arg *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return f.DescribeImagesFn(ctx, arg, opts...)
+}
@@ -18,19 +18,24 @@ package ecr
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/stream"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes"
-	"github.com/htcat/htcat"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context/ctxhttp"
@@ -40,9 +45,25 @@ import (
 // used to pull images from Amazon ECR.
 type ecrFetcher struct {
 	ecrBase
+	// httpClient is used to download layers.  If nil, http.DefaultClient is
+	// used.
+	httpClient  *http.Client
 	parallelism int
+	// foreignLayerHosts are the host patterns foreign layers may be
+	// downloaded from.  If empty, any host is allowed.
+	foreignLayerHosts []string
+	// chunkSize is the size of the ranges requested by parallel downloads.
+	chunkSize int64
+	// memoryLimit caps the memory used to buffer the ranges of a parallel
+	// download.
+	memoryLimit int64
+	retryPolicy RetryPolicy
 }
 
+// defaultLayerDownloadChunkSize is the size of the ranges requested by
+// parallel downloads when no chunk size is configured.
+const defaultLayerDownloadChunkSize = 8 * 1024 * 1024
+
 var _ remotes.Fetcher = (*ecrFetcher)(nil)
 
 func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
@@ -52,9 +73,13 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 	switch desc.MediaType {
 	case
 		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
 		images.MediaTypeDockerSchema2Manifest,
+		images.MediaTypeDockerSchema2ManifestList,
 		images.MediaTypeDockerSchema1Manifest:
 		return f.fetchManifest(ctx, desc)
+	case mediaTypeArtifactManifest:
+		return f.fetchManifest(ctx, desc, desc.MediaType)
 	case
 		images.MediaTypeDockerSchema2Layer,
 		images.MediaTypeDockerSchema2LayerGzip,
@@ -67,23 +92,55 @@ func (f *ecrFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.Rea
 		images.MediaTypeDockerSchema2LayerForeignGzip:
 		return f.fetchForeignLayer(ctx, desc)
 	default:
-		log.G(ctx).
-			WithField("media type", desc.MediaType).
-			Error("ecr.fetcher: unimplemented media type")
-		return nil, unimplemented
+		return f.fetchArtifact(ctx, desc)
+	}
+}
+
+// fetchArtifact fetches content with a media type that is not known to be
+// either a manifest or a layer, such as an OCI artifact or a new layer format.
+// Most such content is stored in Amazon ECR as a layer, so it is fetched as a
+// layer first.  If Amazon ECR has no layer with the digest, the content is
+// fetched as a manifest instead.
+func (f *ecrFetcher) fetchArtifact(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	log.G(ctx).WithField("media type", desc.MediaType).Debug("ecr.fetcher.artifact")
+	body, err := f.fetchLayer(ctx, desc)
+	if err == nil || !errdefs.IsNotFound(err) {
+		return body, err
 	}
-	return nil, unimplemented
+	log.G(ctx).
+		WithError(err).
+		Debug("ecr.fetcher.artifact: no layer found, fetching as a manifest")
+	return f.fetchManifest(ctx, desc, desc.MediaType)
 }
 
-func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
-	image, err := f.getManifest(ctx)
+// fetchManifest fetches the manifest described by desc.  Manifests with one of
+// the additional media types are accepted as well as the supported image
+// manifest types.
+func (f *ecrFetcher) fetchManifest(ctx context.Context, desc ocispec.Descriptor, additionalMediaTypes ...string) (io.ReadCloser, error) {
+	// Manifests are always requested by digest, rather than by the ref's tag,
+	// so that the tag moving between Resolve and Fetch cannot change the
+	// content returned.  Manifests referenced from an index are only
+	// addressable by digest anyway.
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.fetcher.manifest: invalid digest %q: %v", desc.Digest, err)
+	}
+	image, err := f.getImage(ctx, &ecr.ImageIdentifier{ImageDigest: aws.String(desc.Digest.String())}, additionalMediaTypes...)
 	if err != nil {
 		return nil, err
 	}
 	if image == nil {
 		return nil, errors.New("fetchManifest: nil image")
 	}
-	return ioutil.NopCloser(bytes.NewReader([]byte(aws.StringValue(image.ImageManifest)))), nil
+	manifest := []byte(aws.StringValue(image.ImageManifest))
+	if actual := desc.Digest.Algorithm().FromBytes(manifest); actual != desc.Digest {
+		log.G(ctx).
+			WithField("expected", desc.Digest).
+			WithField("actual", actual).
+			Error("ecr.fetcher.manifest: digest mismatch")
+		return nil, errors.Wrapf(errdefs.ErrFailedPrecondition,
+			"ecr.fetcher.manifest: unexpected digest %v, expected %v", actual, desc.Digest)
+	}
+	return ioutil.NopCloser(bytes.NewReader(manifest)), nil
 }
 
 func (f *ecrFetcher) fetchLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
@@ -95,26 +152,159 @@ func (f *ecrFetcher) fetchLayer(ctx context.Context, desc ocispec.Descriptor) (i
 	}
 	output, err := f.client.GetDownloadUrlForLayerWithContext(ctx, getDownloadUrlForLayerInput)
 	if err != nil {
-		return nil, err
+		return nil, ecrerr.FromAWSError("GetDownloadUrlForLayer", err)
 	}
 
 	downloadURL := aws.StringValue(output.DownloadUrl)
+	var body io.ReadCloser
 	if f.parallelism > 0 {
-		return f.fetchLayerHtcat(ctx, desc, downloadURL)
+		body, err = f.fetchLayerParallel(ctx, desc, downloadURL)
+	} else {
+		body, err = f.fetchLayerURL(ctx, desc, downloadURL)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return f.fetchLayerURL(ctx, desc, downloadURL)
+	return newVerifyingReader(body, desc)
 }
 
 func (f *ecrFetcher) fetchForeignLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
 	log.G(ctx).Debug("ecr.fetcher.layer.foreign")
 	if len(desc.URLs) < 1 {
-		log.G(ctx).Error("cannot pull foreign layer without URL")
+		log.G(ctx).Error("ecr.fetcher.layer.foreign: cannot pull foreign layer without URL")
+		return nil, errors.Wrap(errdefs.ErrInvalidArgument, "ecr.fetcher.layer.foreign: foreign layer has no URLs")
+	}
+	// try each URL in order until one can be opened
+	var lastErr error
+	for _, layerURL := range desc.URLs {
+		if err := f.allowForeignLayerURL(layerURL); err != nil {
+			log.G(ctx).
+				WithError(err).
+				WithField("url", layerURL).
+				Warn("ecr.fetcher.layer.foreign: skipping URL")
+			lastErr = err
+			continue
+		}
+		body, err := f.fetchLayerURL(ctx, desc, layerURL)
+		if err != nil {
+			log.G(ctx).
+				WithError(err).
+				WithField("url", layerURL).
+				Warn("ecr.fetcher.layer.foreign: failed to fetch from URL")
+			lastErr = err
+			continue
+		}
+		return newVerifyingReader(body, desc)
+	}
+	return nil, lastErr
+}
+
+// allowForeignLayerURL returns an error satisfying
+// errdefs.IsFailedPrecondition if foreign layers may not be downloaded from
+// layerURL.  Only http and https URLs are allowed, and when host patterns are
+// configured, the host of the URL must match one of them.
+func (f *ecrFetcher) allowForeignLayerURL(layerURL string) error {
+	parsed, err := url.Parse(layerURL)
+	if err != nil {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.fetcher.layer.foreign: invalid URL %q: %v", layerURL, err)
 	}
-	// TODO try more than one URL
-	return f.fetchLayerURL(ctx, desc, desc.URLs[0])
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.fetcher.layer.foreign: unsupported URL scheme %q", parsed.Scheme)
+	}
+	if len(f.foreignLayerHosts) == 0 {
+		return nil
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, pattern := range f.foreignLayerHosts {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return nil
+		}
+	}
+	return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.fetcher.layer.foreign: host %q is not allowed", host)
 }
 
 func (f *ecrFetcher) fetchLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	return newResumableReader(ctx, f.retryPolicy, desc.Size, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		resp, err := f.openLayerURL(ctx, desc, downloadURL, offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	})
+}
+
+// fetchLayerParallel downloads the layer at downloadURL with parallel range
+// requests.  Each range is retried on its own, and the ranges buffered in
+// memory are bounded by the configured memory limit.
+func (f *ecrFetcher) fetchLayerParallel(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
+	chunkSize := f.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultLayerDownloadChunkSize
+	}
+	if desc.Size <= chunkSize {
+		// the size is needed to divide the layer into ranges, and a layer
+		// that fits into a single range gains nothing from parallelism
+		return f.fetchLayerURL(ctx, desc, downloadURL)
+	}
+	maxBuffered := f.parallelism
+	if f.memoryLimit > 0 {
+		maxBuffered = int(f.memoryLimit / chunkSize)
+	}
+	log.G(ctx).
+		WithField("url", downloadURL).
+		WithField("chunkSize", chunkSize).
+		WithField("maxBuffered", maxBuffered).
+		Debug("ecr.fetcher.layer.parallel")
+	return stream.ParallelRangeReader(ctx, desc.Size, chunkSize, f.parallelism, maxBuffered,
+		func(ctx context.Context, begin, end int64) ([]byte, error) {
+			var b []byte
+			err := f.retryPolicy.do(ctx, func() error {
+				var err error
+				b, err = f.fetchLayerRange(ctx, desc, downloadURL, begin, end)
+				return err
+			})
+			if err != nil {
+				log.G(ctx).
+					WithError(err).
+					WithField("begin", begin).
+					WithField("end", end).
+					Error("ecr.fetcher.layer.parallel: failed to download range")
+			}
+			return b, err
+		}), nil
+}
+
+// fetchLayerRange downloads bytes begin through end of the layer at
+// downloadURL.  When the response carries a Content-MD5 header, the range is
+// checked against it.  An incomplete or corrupted range is reported as
+// errdefs.ErrUnavailable so that it can be requested again.
+func (f *ecrFetcher) fetchLayerRange(ctx context.Context, desc ocispec.Descriptor, downloadURL string, begin, end int64) ([]byte, error) {
+	resp, err := f.openLayerURL(ctx, desc, downloadURL, begin, end)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b := make([]byte, end-begin+1)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, errors.Wrapf(errdefs.ErrUnavailable, "ecr.fetcher.layer.range: failed to read range %d-%d: %v", begin, end, err)
+	}
+	// the checksum of a response ignoring the range covers the whole layer
+	if checksum := resp.Header.Get("Content-MD5"); checksum != "" && resp.StatusCode == http.StatusPartialContent {
+		sum := md5.Sum(b)
+		if actual := base64.StdEncoding.EncodeToString(sum[:]); actual != checksum {
+			return nil, errors.Wrapf(errdefs.ErrUnavailable,
+				"ecr.fetcher.layer.range: range %d-%d has checksum %v, expected %v", begin, end, actual, checksum)
+		}
+	}
+	return b, nil
+}
+
+// openLayerURL requests the content at downloadURL from offset through end,
+// or through the end of the content if end is negative.  The body of the
+// response starts at offset.  Throttling, server errors, and failed
+// connections are reported as errdefs.ErrUnavailable so that they can be
+// retried.
+func (f *ecrFetcher) openLayerURL(ctx context.Context, desc ocispec.Descriptor, downloadURL string, offset, end int64) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodGet, downloadURL, nil)
 	if err != nil {
 		log.G(ctx).
@@ -123,54 +313,47 @@ func (f *ecrFetcher) fetchLayerURL(ctx context.Context, desc ocispec.Descriptor,
 			Error("ecr.fetcher.layer.url: failed to create HTTP request")
 		return nil, err
 	}
-	log.G(ctx).WithField("url", downloadURL).Debug("ecr.fetcher.layer.url")
+	log.G(ctx).WithField("url", downloadURL).WithField("offset", offset).Debug("ecr.fetcher.layer.url")
 
 	req.Header.Set("Accept", strings.Join([]string{desc.MediaType, `*`}, ", "))
+	if end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+	} else if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
 	resp, err := f.doRequest(ctx, req)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(errdefs.ErrUnavailable, "ecr.fetcher.layer.url: %v", err)
 	}
 	if resp.StatusCode > 299 {
 		resp.Body.Close()
-		if resp.StatusCode == http.StatusNotFound {
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
 			return nil, errors.Wrapf(errdefs.ErrNotFound, "content at %v not found", downloadURL)
+		case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= http.StatusInternalServerError:
+			return nil, errors.Wrapf(errdefs.ErrUnavailable, "ecr.fetcher.layer.url: unexpected status code %v: %v", downloadURL, resp.Status)
 		}
 		return nil, errors.Errorf("ecr.fetcher.layer.url: unexpected status code %v: %v", downloadURL, resp.Status)
 	}
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the server ignored the range; skip the content already read
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, errors.Wrapf(errdefs.ErrUnavailable, "ecr.fetcher.layer.url: failed to skip to offset %d: %v", offset, err)
+		}
+	}
 	log.G(ctx).WithField("desc", desc).Debug("ecr.fetcher.layer.url: returning body")
-	return resp.Body, nil
+	return resp, nil
 }
 
 func (f *ecrFetcher) doRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
-	client := http.DefaultClient // TODO
+	client := f.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
 	resp, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to do request")
 	}
 	return resp, nil
 }
-
-func (f *ecrFetcher) fetchLayerHtcat(ctx context.Context, desc ocispec.Descriptor, downloadURL string) (io.ReadCloser, error) {
-	log.G(ctx).WithField("url", downloadURL).Debug("ecr.fetcher.layer.htcat")
-	parsedURL, err := url.Parse(downloadURL)
-	if err != nil {
-		log.G(ctx).
-			WithError(err).
-			WithField("url", downloadURL).
-			Error("ecr.fetcher.layer.htcat: failed to parse URL")
-		return nil, err
-	}
-	htc := htcat.New(http.DefaultClient, parsedURL, f.parallelism)
-	pr, pw := io.Pipe()
-	go func() {
-		defer pw.Close()
-		_, err := htc.WriteTo(pw)
-		if err != nil {
-			log.G(ctx).
-				WithError(err).
-				WithField("url", downloadURL).
-				Error("ecr.fetcher.layer.htcat: failed to download layer")
-		}
-	}()
-	return pr, nil
-}
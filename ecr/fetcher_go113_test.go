@@ -0,0 +1,89 @@
+//go:build go1.13
+// +build go1.13
+
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFetchErrorsIs checks that the errors returned from Fetch can be
+// classified with errors.Is from the standard library, both for errors from
+// the Amazon ECR API and for errdefs errors wrapped with github.com/pkg/errors.
+func TestFetchErrorsIs(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			"fake": fakeClient,
+		},
+	}
+	fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err, "failed to create fetcher")
+
+	for _, desc := range []ocispec.Descriptor{
+		{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("manifest"),
+		},
+		{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString("layer"),
+			Size:      5,
+		},
+		{
+			MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+			Digest:    digest.FromString("foreign layer"),
+			URLs:      []string{ts.URL},
+		},
+	} {
+		t.Run(desc.MediaType, func(t *testing.T) {
+			_, err := fetcher.Fetch(context.Background(), desc)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, errdefs.ErrNotFound), "errors.Is should find ErrNotFound in %v", err)
+			assert.True(t, errdefs.IsNotFound(err), "errdefs.IsNotFound should find ErrNotFound in %v", err)
+		})
+	}
+}
@@ -18,16 +18,22 @@ package ecr
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/errdefs"
@@ -39,13 +45,74 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestFetchUnimplemented(t *testing.T) {
-	fetcher := &ecrFetcher{}
+func TestFetchArtifactLayer(t *testing.T) {
+	expectedBody := "hello this is a wasm module"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, expectedBody)
+	}))
+	defer ts.Close()
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+				// BatchGetImageFn is nil, so fetching a manifest would panic
+			},
+		},
+	}
+
+	for _, mediaType := range []string{
+		"application/vnd.oci.image.layer.v1.tar+zstd",
+		"application/vnd.oci.image.layer.v1.tar+gzip+encrypted",
+		"application/vnd.wasm.content.layer.v1+wasm",
+		"never-implemented",
+	} {
+		t.Run(mediaType, func(t *testing.T) {
+			desc := ocispec.Descriptor{
+				MediaType: mediaType,
+				Digest:    digest.FromString(expectedBody),
+				Size:      int64(len(expectedBody)),
+			}
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err, "fetch")
+			defer reader.Close()
+			body, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedBody, string(body))
+		})
+	}
+}
+
+func TestFetchArtifactManifest(t *testing.T) {
+	const mediaType = "application/vnd.oci.artifact.manifest.v1+json"
+	manifest := `{"mediaType":"` + mediaType + `","artifactType":"application/vnd.example.sbom"}`
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return nil, awserr.New(ecr.ErrCodeLayersNotFoundException, "not a layer", nil)
+				},
+				BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					assert.Contains(t, aws.StringValueSlice(input.AcceptedMediaTypes), mediaType)
+					assert.Len(t, input.AcceptedMediaTypes, len(supportedImageMediaTypes)+1)
+					return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String(manifest)}}}, nil
+				},
+			},
+		},
+	}
 	desc := ocispec.Descriptor{
-		MediaType: "never-implemented",
+		MediaType: mediaType,
+		Digest:    digest.FromString(manifest),
+		Size:      int64(len(manifest)),
 	}
-	_, err := fetcher.Fetch(context.Background(), desc)
-	assert.EqualError(t, err, unimplemented.Error())
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err, "fetch")
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest, string(body))
+	assert.Len(t, supportedImageMediaTypes, 4, "the supported media types should not be modified")
 }
 
 func TestFetchForeignLayer(t *testing.T) {
@@ -67,6 +134,8 @@ func TestFetchForeignLayer(t *testing.T) {
 			// input
 			desc := ocispec.Descriptor{
 				MediaType: mediaType,
+				Digest:    digest.FromString(expectedBody),
+				Size:      int64(len(expectedBody)),
 				URLs:      []string{ts.URL},
 			}
 
@@ -99,11 +168,81 @@ func TestFetchForeignLayerNotFound(t *testing.T) {
 	assert.Equal(t, errdefs.ErrNotFound, cause)
 }
 
+func TestFetchForeignLayerNoURLs(t *testing.T) {
+	fetcher := &ecrFetcher{}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    digest.FromString("hello this is dog"),
+	}
+	_, err := fetcher.Fetch(context.Background(), desc)
+	assert.Error(t, err)
+	assert.Equal(t, errdefs.ErrInvalidArgument, errors.Cause(err))
+}
+
+func TestFetchForeignLayerFallback(t *testing.T) {
+	expectedBody := "hello this is dog"
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, expectedBody)
+	}))
+	defer ts.Close()
+
+	fetcher := &ecrFetcher{}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    digest.FromString(expectedBody),
+		Size:      int64(len(expectedBody)),
+		URLs:      []string{"file:///etc/passwd", missing.URL, ts.URL},
+	}
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err, "fetch should fall back to the last URL")
+	defer reader.Close()
+	output, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedBody, string(output))
+}
+
+func TestFetchForeignLayerHosts(t *testing.T) {
+	expectedBody := "hello this is dog"
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, expectedBody)
+	}))
+	defer ts.Close()
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    digest.FromString(expectedBody),
+		Size:      int64(len(expectedBody)),
+		URLs:      []string{ts.URL},
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		fetcher := &ecrFetcher{foreignLayerHosts: []string{"*.example.com", "127.0.0.*"}}
+		reader, err := fetcher.Fetch(context.Background(), desc)
+		require.NoError(t, err, "fetch")
+		defer reader.Close()
+		output, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedBody, string(output))
+	})
+	t.Run("denied", func(t *testing.T) {
+		calls = 0
+		fetcher := &ecrFetcher{foreignLayerHosts: []string{"*.example.com"}}
+		_, err := fetcher.Fetch(context.Background(), desc)
+		assert.Error(t, err)
+		assert.Equal(t, errdefs.ErrFailedPrecondition, errors.Cause(err))
+		assert.Equal(t, 0, calls, "a denied host should not be contacted")
+	})
+}
+
 func TestFetchManifest(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
 	imageTag := "tag"
 	imageManifest := "image manifest"
+	imageDigest := digest.FromString(imageManifest)
 	fakeClient := &fakeECRClient{}
 	fetcher := &ecrFetcher{
 		ecrBase: ecrBase{
@@ -121,7 +260,9 @@ func TestFetchManifest(t *testing.T) {
 	// test all supported media types
 	for _, mediaType := range []string{
 		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
 		images.MediaTypeDockerSchema2Manifest,
+		images.MediaTypeDockerSchema2ManifestList,
 		images.MediaTypeDockerSchema1Manifest,
 	} {
 		t.Run(mediaType, func(t *testing.T) {
@@ -130,19 +271,23 @@ func TestFetchManifest(t *testing.T) {
 				callCount++
 				assert.Equal(t, registry, aws.StringValue(input.RegistryId))
 				assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
-				assert.Equal(t, []*ecr.ImageIdentifier{{ImageTag: aws.String(imageTag)}}, input.ImageIds)
+				// manifests are fetched by the descriptor's digest, not the ref's tag
+				assert.Equal(t, []*ecr.ImageIdentifier{{ImageDigest: aws.String(imageDigest.String())}}, input.ImageIds)
 				// TODO: Determine if we should be matching the requested media type from containerd
 				assert.Equal(t, []*string{
 					aws.String(ocispec.MediaTypeImageManifest),
 					aws.String(images.MediaTypeDockerSchema2Manifest),
+					aws.String(ocispec.MediaTypeImageIndex),
+					aws.String(images.MediaTypeDockerSchema2ManifestList),
 				}, input.AcceptedMediaTypes)
 				return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String(imageManifest)}}}, nil
 			}
 			desc := ocispec.Descriptor{
 				MediaType: mediaType,
+				Digest:    imageDigest,
 			}
 			reader, err := fetcher.Fetch(context.Background(), desc)
-			assert.NoError(t, err, "fetch")
+			require.NoError(t, err, "fetch")
 			defer reader.Close()
 			assert.Equal(t, 1, callCount, "BatchGetImage should be called once")
 			manifest, err := ioutil.ReadAll(reader)
@@ -152,6 +297,41 @@ func TestFetchManifest(t *testing.T) {
 	}
 }
 
+func TestFetchManifestDigestMismatch(t *testing.T) {
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{ImageManifest: aws.String("moved tag")}}}, nil
+		},
+	}
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("image manifest"),
+	}
+	_, err := fetcher.Fetch(context.Background(), desc)
+	assert.Error(t, err)
+	assert.Equal(t, errdefs.ErrFailedPrecondition, errors.Cause(err))
+}
+
+func TestFetchManifestInvalidDigest(t *testing.T) {
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			// BatchGetImageFn is nil, so reaching the API would panic
+			client: &fakeECRClient{},
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	_, err := fetcher.Fetch(context.Background(), desc)
+	assert.Error(t, err)
+	assert.Equal(t, errdefs.ErrInvalidArgument, errors.Cause(err))
+}
+
 func TestFetchManifestAPIError(t *testing.T) {
 	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
 	mediaType := ocispec.MediaTypeImageManifest
@@ -162,13 +342,16 @@ func TestFetchManifestAPIError(t *testing.T) {
 		},
 	}
 	resolver := &ecrResolver{
-		clients: map[string]ecrAPI{
+		clients: map[string]ECRClient{
 			"fake": fakeClient,
 		},
 	}
 	fetcher, err := resolver.Fetcher(context.Background(), ref)
 	require.NoError(t, err, "failed to create fetcher")
-	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: mediaType})
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromString("image manifest"),
+	})
 	assert.EqualError(t, err, "expected")
 }
 
@@ -186,20 +369,24 @@ func TestFetchManifestNotFound(t *testing.T) {
 		},
 	}
 	resolver := &ecrResolver{
-		clients: map[string]ecrAPI{
+		clients: map[string]ECRClient{
 			"fake": fakeClient,
 		},
 	}
 	fetcher, err := resolver.Fetcher(context.Background(), ref)
 	require.NoError(t, err, "failed to create fetcher")
-	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{MediaType: mediaType})
+	_, err = fetcher.Fetch(context.Background(), ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromString("image manifest"),
+	})
 	assert.Error(t, err)
 }
 
 func TestFetchLayer(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
-	layerDigest := "digest"
+	expectedBody := "hello this is dog"
+	layerDigest := digest.FromString(expectedBody).String()
 	fakeClient := &fakeECRClient{}
 	fetcher := &ecrFetcher{
 		ecrBase: ecrBase{
@@ -212,7 +399,6 @@ func TestFetchLayer(t *testing.T) {
 			},
 		},
 	}
-	expectedBody := "hello this is dog"
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, expectedBody)
 	}))
@@ -239,6 +425,7 @@ func TestFetchLayer(t *testing.T) {
 			desc := ocispec.Descriptor{
 				MediaType: mediaType,
 				Digest:    digest.Digest(layerDigest),
+				Size:      int64(len(expectedBody)),
 			}
 			reader, err := fetcher.Fetch(context.Background(), desc)
 			assert.NoError(t, err, "fetch")
@@ -269,10 +456,9 @@ func TestFetchLayerAPIError(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestFetchLayerHtcat(t *testing.T) {
+func TestFetchLayerParallel(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
-	layerDigest := "digest"
 	fakeClient := &fakeECRClient{}
 	fetcher := &ecrFetcher{
 		ecrBase: ecrBase{
@@ -286,16 +472,22 @@ func TestFetchLayerHtcat(t *testing.T) {
 		},
 		parallelism: 2,
 	}
-	// need >1mb of content for htcat to do parallel requests
+	// need more than one chunk of content to do parallel requests
 	const (
 		kB = 1024 * 1
 		mB = 1024 * kB
 	)
 	expectedBody := make([]byte, 30*mB)
 	rand.Read(expectedBody)
-	handlerCallCount := 0
+	layerDigest := digest.FromBytes(expectedBody).String()
+	var (
+		handlerLock      sync.Mutex
+		handlerCallCount int
+	)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerLock.Lock()
 		handlerCallCount++
+		handlerLock.Unlock()
 		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(expectedBody))
 	}))
 	defer ts.Close()
@@ -311,6 +503,7 @@ func TestFetchLayerHtcat(t *testing.T) {
 	desc := ocispec.Descriptor{
 		MediaType: images.MediaTypeDockerSchema2Layer,
 		Digest:    digest.Digest(layerDigest),
+		Size:      int64(len(expectedBody)),
 	}
 	reader, err := fetcher.Fetch(context.Background(), desc)
 	assert.NoError(t, err, "fetch")
@@ -321,3 +514,303 @@ func TestFetchLayerHtcat(t *testing.T) {
 	assert.Equal(t, expectedBody, body)
 	assert.True(t, handlerCallCount > 1, "ServeContent should be called more than once: %d", handlerCallCount)
 }
+
+func TestFetchLayerVerify(t *testing.T) {
+	expectedBody := "hello this is dog"
+	for _, tc := range []struct {
+		name  string
+		body  string
+		check func(error) bool
+	}{
+		// a truncated download is a failed transfer, which can be resumed
+		{"truncated", expectedBody[:5], errdefs.IsUnavailable},
+		{"too long", expectedBody + " and cat", errdefs.IsFailedPrecondition},
+		{"corrupted", strings.ToUpper(expectedBody), errdefs.IsFailedPrecondition},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tc.body)
+			}))
+			defer ts.Close()
+
+			fetcher := &ecrFetcher{
+				ecrBase: ecrBase{
+					client: &fakeECRClient{
+						GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+							return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+						},
+					},
+				},
+			}
+			desc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    digest.FromString(expectedBody),
+				Size:      int64(len(expectedBody)),
+			}
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err, "fetch")
+			defer reader.Close()
+			data, err := ioutil.ReadAll(reader)
+			assert.True(t, tc.check(err), "reading should fail verification: %v", err)
+			assert.True(t, int64(len(data)) <= desc.Size, "read %d bytes past the expected size", int64(len(data))-desc.Size)
+		})
+	}
+}
+
+// newParallelTestFetcher returns a fetcher with parallel downloads of 1 MiB
+// ranges from a server running handler.
+func newParallelTestFetcher(t *testing.T, handler http.HandlerFunc) (*ecrFetcher, func()) {
+	ts := httptest.NewServer(handler)
+	fetcher := &ecrFetcher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+					return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+				},
+			},
+		},
+		parallelism: 2,
+		chunkSize:   1024 * 1024,
+	}
+	return fetcher, ts.Close
+}
+
+// failMidRange serves content, except that the first request for a range
+// after the start of the content is cut off partway through.
+func failMidRange(t *testing.T, content []byte) http.HandlerFunc {
+	var (
+		lock   sync.Mutex
+		failed bool
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		lock.Lock()
+		fail := !failed && rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
+		if fail {
+			failed = true
+		}
+		lock.Unlock()
+		if !fail {
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+			return
+		}
+		var start, end int
+		_, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+		if err != nil {
+			end = len(content) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : start+(end-start)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}
+}
+
+func TestFetchLayerParallelMidRangeFailure(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	fetcher, closeServer := newParallelTestFetcher(t, failMidRange(t, content))
+	defer closeServer()
+
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err, "fetch")
+	defer reader.Close()
+	_, err = ioutil.ReadAll(reader)
+	assert.True(t, errdefs.IsUnavailable(err), "reading should fail with the download error: %v", err)
+}
+
+func TestFetchLayerParallelMidRangeRetry(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	fetcher, closeServer := newParallelTestFetcher(t, failMidRange(t, content))
+	defer closeServer()
+	fetcher.retryPolicy = RetryPolicy{MaxAttempts: 2}
+
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	reader, err := fetcher.Fetch(context.Background(), desc)
+	require.NoError(t, err, "fetch")
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, content, body)
+}
+
+func TestFetchLayerParallelCancel(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	canceled := make(chan struct{}, 10)
+	fetcher, closeServer := newParallelTestFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+			return
+		}
+		// hang every later range until the client gives up
+		<-r.Context().Done()
+		canceled <- struct{}{}
+	})
+	defer closeServer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	reader, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err, "fetch")
+	defer reader.Close()
+
+	readErr := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(reader)
+		readErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-readErr:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not released after cancellation")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight range request was not canceled")
+	}
+}
+
+// corruptOnce serves ranges of content with a Content-MD5 header, except that
+// the body of the first range after the start of the content is corrupted.
+func corruptOnce(t *testing.T, content []byte) http.HandlerFunc {
+	var (
+		lock      sync.Mutex
+		corrupted bool
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		require.NoError(t, err)
+		body := append([]byte(nil), content[start:end+1]...)
+		sum := md5.Sum(body)
+		lock.Lock()
+		if !corrupted && start > 0 {
+			corrupted = true
+			body[0] ^= 0xff
+		}
+		lock.Unlock()
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body)
+	}
+}
+
+func TestFetchLayerParallelChecksum(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+
+	t.Run("no retry", func(t *testing.T) {
+		fetcher, closeServer := newParallelTestFetcher(t, corruptOnce(t, content))
+		defer closeServer()
+		reader, err := fetcher.Fetch(context.Background(), desc)
+		require.NoError(t, err, "fetch")
+		defer reader.Close()
+		_, err = ioutil.ReadAll(reader)
+		assert.True(t, errdefs.IsUnavailable(err), "reading should fail the checksum: %v", err)
+	})
+	t.Run("retry", func(t *testing.T) {
+		fetcher, closeServer := newParallelTestFetcher(t, corruptOnce(t, content))
+		defer closeServer()
+		fetcher.retryPolicy = RetryPolicy{MaxAttempts: 2}
+		reader, err := fetcher.Fetch(context.Background(), desc)
+		require.NoError(t, err, "fetch")
+		defer reader.Close()
+		body, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, content, body)
+	})
+}
+
+// countingTransport is an http.RoundTripper that counts the requests made
+// through it.
+type countingTransport struct {
+	lock     sync.Mutex
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.lock.Lock()
+	c.requests++
+	c.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFetchLayerHTTPClient(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	rand.Read(content)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	fakeClient := &fakeECRClient{
+		GetDownloadUrlForLayerFn: func(aws.Context, *ecr.GetDownloadUrlForLayerInput, ...request.Option) (*ecr.GetDownloadUrlForLayerOutput, error) {
+			return &ecr.GetDownloadUrlForLayerOutput{DownloadUrl: aws.String(ts.URL)}, nil
+		},
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+
+	for _, tc := range []struct {
+		name             string
+		parallelism      int
+		expectedRequests int
+	}{
+		{"single request", 0, 1},
+		{"parallel", 2, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &countingTransport{}
+			resolver := &ecrResolver{
+				clients: map[string]ECRClient{
+					"fake": fakeClient,
+				},
+				httpClient:               &http.Client{Transport: transport},
+				layerDownloadParallelism: tc.parallelism,
+				layerDownloadChunkSize:   1024 * 1024,
+			}
+			fetcher, err := resolver.Fetcher(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest")
+			require.NoError(t, err, "failed to create fetcher")
+			reader, err := fetcher.Fetch(context.Background(), desc)
+			require.NoError(t, err, "fetch")
+			defer reader.Close()
+			body, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, content, body)
+			assert.Equal(t, tc.expectedRequests, transport.requests, "all requests should use the configured client")
+		})
+	}
+}
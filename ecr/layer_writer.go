@@ -17,15 +17,21 @@ package ecr
 
 import (
 	"context"
+	// register the hashes for the digest algorithms verified locally
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding"
+	"hash"
 	"io"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
 	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/stream"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
@@ -34,14 +40,49 @@ import (
 )
 
 type layerWriter struct {
-	ctx      context.Context
-	base     *ecrBase
-	desc     ocispec.Descriptor
-	buf      io.WriteCloser
-	tracker  docker.StatusTracker
-	ref      string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	base        *ecrBase
+	desc        ocispec.Descriptor
+	buf         *io.PipeWriter
+	tracker     docker.StatusTracker
+	ref         string
+	retryPolicy RetryPolicy
+	store       UploadStore
+	// algorithm is the digest algorithm used to verify the content locally.
+	algorithm digest.Algorithm
+
+	// reader is the read side of buf, from which parts are read and
+	// uploaded, with up to queueSize parts read ahead.
+	reader    *io.PipeReader
+	queueSize int64
+	// startOnce starts the upload of parts on the first call to Write,
+	// Commit, or Close, so that Truncate can replace the upload before any
+	// part is uploaded.
+	startOnce sync.Once
+	// done is closed once all parts have been uploaded or the upload has
+	// failed, and err is the error that caused the upload to fail.
+	done chan struct{}
+	err  error
+
+	// lock protects the state of the upload below.
+	lock     sync.Mutex
+	started  bool
 	uploadID string
-	err      chan error
+	partSize int64
+	// startOffset is the offset of the first byte written to this writer.
+	// It is non-zero when continuing an upload started by another writer.
+	startOffset int64
+	// written is the number of bytes written to this writer.
+	written int64
+	// acked is the number of bytes acknowledged by Amazon ECR.
+	acked int64
+	// hash is the hash of the bytes read from the writer so far.  Parts are
+	// hashed as they are read, ahead of being uploaded, and digestStates
+	// holds the marshaled state of hash at the end of each part that has not
+	// yet been acknowledged, by the offset of the end of the part.
+	hash         hash.Hash
+	digestStates map[int64][]byte
 }
 
 var _ content.Writer = (*layerWriter)(nil)
@@ -50,103 +91,407 @@ const (
 	layerQueueSize = 5
 )
 
-func newLayerWriter(base *ecrBase, tracker docker.StatusTracker, ref string, desc ocispec.Descriptor) (content.Writer, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("desc", desc))
+// newLayerWriter returns a writer uploading the layer described by desc with
+// the settings of the pusher.  Amazon ECR requires the parts of an upload to
+// be consecutive, so parts are uploaded one at a time and in order, while the
+// parts that follow are read and hashed ahead.  The upload is bound to ctx:
+// canceling it stops the part being uploaded and fails the writer.  If the
+// pusher has an UploadStore with the
+// state of an earlier upload of the same layer, the upload is continued from
+// the last part acknowledged by Amazon ECR and Status reports the offset to
+// continue writing from.  Otherwise a new upload is initiated.  Parts are only
+// uploaded once content is written, or the writer is committed or closed.
+func newLayerWriter(ctx context.Context, p *ecrPusher, ref string, desc ocispec.Descriptor) (content.Writer, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	reader, writer := io.Pipe()
 	lw := &layerWriter{
-		ctx:     ctx,
-		base:    base,
-		desc:    desc,
-		buf:     writer,
-		tracker: tracker,
-		ref:     ref,
-		err:     make(chan error),
+		ctx:          ctx,
+		cancel:       cancel,
+		base:         &p.ecrBase,
+		desc:         desc,
+		buf:          writer,
+		reader:       reader,
+		tracker:      p.tracker,
+		ref:          ref,
+		retryPolicy:  p.retryPolicy,
+		store:        p.uploadStore,
+		done:         make(chan struct{}),
+		algorithm:    layerDigestAlgorithm(desc),
+		digestStates: map[int64][]byte{},
 	}
 
-	// call InitiateLayerUpload and get upload ID
-	initiateLayerUploadInput := &ecr.InitiateLayerUploadInput{
-		RegistryId:     aws.String(base.ecrSpec.Registry()),
-		RepositoryName: aws.String(base.ecrSpec.Repository),
-	}
-	initiateLayerUploadOutput, err := base.client.InitiateLayerUpload(initiateLayerUploadInput)
-	if err != nil {
-		return nil, err
+	if !lw.resume() {
+		if err := lw.initiate(); err != nil {
+			cancel()
+			return nil, err
+		}
 	}
-	lw.uploadID = aws.StringValue(initiateLayerUploadOutput.UploadId)
-	partSize := aws.Int64Value(initiateLayerUploadOutput.PartSize)
 	log.G(ctx).
 		WithField("digest", desc.Digest.String()).
 		WithField("uploadID", lw.uploadID).
-		WithField("partSize", partSize).
+		WithField("partSize", lw.partSize).
+		WithField("offset", lw.startOffset).
+		WithField("readAhead", p.uploadReadAhead).
 		Debug("ecr.blob.init")
+	queueSize, err := layerUploadQueueSize(p.uploadReadAhead, p.uploadMemoryLimit, lw.partSize)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	lw.queueSize = queueSize
+	if lw.startOffset > 0 {
+		if err := lw.addOffset(lw.startOffset); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
 
+	// reads from the pipe cannot be canceled, so close it to unblock both
+	// sides when the context is canceled
 	go func() {
-		defer cancel()
-		defer close(lw.err)
-		_, err := stream.ChunkedProcessor(reader, partSize, layerQueueSize,
-			func(layerChunk *stream.Chunk) error {
-				begin := layerChunk.BytesBegin
-				end := layerChunk.BytesEnd
-				bytesRead := end - begin
-				log.G(ctx).
-					WithField("digest", desc.Digest.String()).
-					WithField("part", layerChunk.Part).
-					WithField("begin", begin).
-					WithField("end", end).
-					WithField("bytes", bytesRead).
-					Debug("ecr.layer.callback")
-
-				uploadLayerPartInput := &ecr.UploadLayerPartInput{
-					RegistryId:     aws.String(base.ecrSpec.Registry()),
-					RepositoryName: aws.String(base.ecrSpec.Repository),
-					UploadId:       aws.String(lw.uploadID),
-					PartFirstByte:  aws.Int64(begin),
-					PartLastByte:   aws.Int64(end),
-					LayerPartBlob:  layerChunk.Bytes,
-				}
+		<-ctx.Done()
+		reader.CloseWithError(ctx.Err())
+	}()
+
+	return lw, nil
+}
+
+// start starts uploading the parts written to the writer, if they are not
+// being uploaded already.
+func (lw *layerWriter) start() {
+	lw.startOnce.Do(func() {
+		lw.lock.Lock()
+		lw.started = true
+		partSize := lw.partSize
+		lw.lock.Unlock()
+		go lw.upload(partSize)
+	})
+}
 
-				_, err := base.client.UploadLayerPart(uploadLayerPartInput)
-				log.G(ctx).
-					WithField("digest", desc.Digest.String()).
-					WithField("part", layerChunk.Part).
-					WithField("begin", begin).
-					WithField("end", end).
-					WithField("bytes", bytesRead).
-					Debug("ecr.layer.callback end")
-				if err == nil {
-					var status docker.Status
-					status, err = lw.tracker.GetStatus(lw.ref)
-					if err == nil {
-						status.Offset += int64(bytesRead) + 1
-						status.UpdatedAt = time.Now()
-						lw.tracker.SetStatus(lw.ref, status)
-					}
+// upload uploads the parts read from the pipe until it is closed or an upload
+// fails, then closes lw.done.
+func (lw *layerWriter) upload(partSize int64) {
+	ctx, desc, reader := lw.ctx, lw.desc, lw.reader
+	defer lw.cancel()
+	defer close(lw.done)
+	_, err := stream.ChunkedProcessor(ctx, &hashingReader{lw: lw, reader: reader, partSize: partSize}, partSize, lw.queueSize,
+		func(layerChunk *stream.Chunk) error {
+			lw.lock.Lock()
+			uploadID := lw.uploadID
+			begin := lw.startOffset + layerChunk.BytesBegin
+			end := lw.startOffset + layerChunk.BytesEnd
+			lw.lock.Unlock()
+			bytesRead := end - begin
+			log.G(ctx).
+				WithField("digest", desc.Digest.String()).
+				WithField("part", layerChunk.Part).
+				WithField("begin", begin).
+				WithField("end", end).
+				WithField("bytes", bytesRead).
+				Debug("ecr.layer.callback")
+
+			uploadLayerPartInput := &ecr.UploadLayerPartInput{
+				RegistryId:     aws.String(lw.base.ecrSpec.Registry()),
+				RepositoryName: aws.String(lw.base.ecrSpec.Repository),
+				UploadId:       aws.String(uploadID),
+				PartFirstByte:  aws.Int64(begin),
+				PartLastByte:   aws.Int64(end),
+				LayerPartBlob:  layerChunk.Bytes,
+			}
+
+			// the part is held in memory, so a transient failure only
+			// needs this part to be uploaded again
+			err := lw.retryPolicy.do(ctx, func() error {
+				_, err := lw.base.client.UploadLayerPartWithContext(ctx, uploadLayerPartInput)
+				if partReceived(err, end) {
+					// an earlier attempt, or an earlier push continued
+					// from a stored state, was received even though
+					// its response was lost
+					log.G(ctx).
+						WithField("digest", desc.Digest.String()).
+						WithField("part", layerChunk.Part).
+						WithField("end", end).
+						Debug("ecr.layer.callback: part already received")
+					return nil
 				}
-				return err
+				return ecrerr.FromAWSError("UploadLayerPart", err)
 			})
-		if err != nil {
-			lw.err <- err
+			log.G(ctx).
+				WithField("digest", desc.Digest.String()).
+				WithField("part", layerChunk.Part).
+				WithField("begin", begin).
+				WithField("end", end).
+				WithField("bytes", bytesRead).
+				Debug("ecr.layer.callback end")
+			if err == nil {
+				lw.acknowledge(end + 1)
+				err = lw.addOffset(int64(bytesRead) + 1)
+			}
+			return err
+		})
+	if err != nil {
+		if errdefs.IsNotFound(err) || errdefs.IsFailedPrecondition(err) {
+			// the upload has expired or no longer matches the
+			// recorded state, so it cannot be continued later
+			lw.deleteState()
 		}
-		log.G(ctx).WithField("digest", desc.Digest.String()).Debug("ecr.layer upload done")
-	}()
-	return lw, nil
+		lw.err = err
+		// fail writes blocked on the pipe, and any later ones, with
+		// the upload error since nothing reads the pipe anymore
+		reader.CloseWithError(err)
+	}
+	log.G(ctx).WithField("digest", desc.Digest.String()).Debug("ecr.layer upload done")
+}
+
+// partReceived reports whether err rejects a part ending at lastByte because
+// Amazon ECR has already received the content through lastByte.
+func partReceived(err error, lastByte int64) bool {
+	invalidPart, ok := err.(*ecr.InvalidLayerPartException)
+	return ok && invalidPart.LastValidByteReceived != nil &&
+		aws.Int64Value(invalidPart.LastValidByteReceived) >= lastByte
+}
+
+// layerUploadQueueSize returns the number of parts to read ahead of the part
+// being uploaded, which is readAhead, or layerQueueSize if it is not set.
+// Besides the queued parts, one part is held in memory while it is uploaded
+// and one while it is read, so the queue is shortened to keep the parts held
+// in memory within memoryLimit, if it is set.
+func layerUploadQueueSize(readAhead int, memoryLimit, partSize int64) (int64, error) {
+	queueSize := int64(layerQueueSize)
+	if readAhead > 0 {
+		queueSize = int64(readAhead)
+	}
+	if memoryLimit <= 0 || partSize <= 0 {
+		return queueSize, nil
+	}
+	maxQueueSize := memoryLimit/partSize - 2
+	if maxQueueSize < 0 {
+		return 0, errors.Wrapf(errdefs.ErrInvalidArgument,
+			"ecr.layer: upload memory limit %d is smaller than two parts of %d bytes", memoryLimit, partSize)
+	}
+	if queueSize > maxQueueSize {
+		queueSize = maxQueueSize
+	}
+	return queueSize, nil
+}
+
+// hashingReader hashes the content of a layer as it is read, ahead of the
+// parts being uploaded, and records the digest state at the end of each part
+// so that the state can be saved once the part is acknowledged.
+type hashingReader struct {
+	lw       *layerWriter
+	reader   io.Reader
+	partSize int64
+	// read is the number of bytes read from reader.
+	read int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	lw := r.lw
+	if r.partSize <= 0 {
+		return 0, errors.Errorf("ecr.layer.hash: invalid part size %d", r.partSize)
+	}
+	// stop reads at the end of each part so that its state can be recorded
+	if remaining := r.partSize - r.read%r.partSize; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.reader.Read(p)
+
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	lw.hash.Write(p[:n])
+	r.read += int64(n)
+	if (n > 0 && r.read%r.partSize == 0) || err == io.EOF {
+		var digestState []byte
+		if marshaler, ok := lw.hash.(encoding.BinaryMarshaler); ok {
+			state, merr := marshaler.MarshalBinary()
+			if merr != nil {
+				log.G(lw.ctx).WithError(merr).Warn("ecr.layer.hash: failed to marshal digest state")
+			}
+			digestState = state
+		}
+		lw.digestStates[lw.startOffset+r.read] = digestState
+	}
+	return n, err
+}
+
+// layerDigestAlgorithm returns the algorithm used to verify the digest of the
+// uploaded content of the layer.
+func layerDigestAlgorithm(desc ocispec.Descriptor) digest.Algorithm {
+	if desc.Digest.Validate() == nil {
+		return desc.Digest.Algorithm()
+	}
+	return digest.Canonical
+}
+
+// initiate starts a new upload with InitiateLayerUpload and records its state.
+// The caller must not hold lw.lock, and parts must not have started uploading.
+func (lw *layerWriter) initiate() error {
+	initiateLayerUploadInput := &ecr.InitiateLayerUploadInput{
+		RegistryId:     aws.String(lw.base.ecrSpec.Registry()),
+		RepositoryName: aws.String(lw.base.ecrSpec.Repository),
+	}
+	initiateLayerUploadOutput, err := lw.base.client.InitiateLayerUploadWithContext(lw.ctx, initiateLayerUploadInput)
+	if err != nil {
+		return ecrerr.FromAWSError("InitiateLayerUpload", err)
+	}
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	lw.uploadID = aws.StringValue(initiateLayerUploadOutput.UploadId)
+	if lw.partSize == 0 {
+		// parts are already being cut at the original size when a
+		// truncated upload is restarted
+		lw.partSize = aws.Int64Value(initiateLayerUploadOutput.PartSize)
+	}
+	lw.startOffset = 0
+	lw.acked = 0
+	lw.hash = lw.algorithm.Hash()
+	lw.digestStates = map[int64][]byte{}
+	lw.saveState(nil)
+	return nil
+}
+
+// resume loads the state of an earlier upload of the layer from the store and
+// reports whether the upload can be continued.
+func (lw *layerWriter) resume() bool {
+	if lw.store == nil {
+		return false
+	}
+	key := uploadKey(lw.base.ecrSpec, lw.desc.Digest)
+	state, err := lw.store.Get(key)
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			log.G(lw.ctx).WithError(err).Warn("ecr.layer.resume: failed to load upload state")
+		}
+		return false
+	}
+	if state.Registry != lw.base.ecrSpec.Registry() ||
+		state.Repository != lw.base.ecrSpec.Repository ||
+		state.Digest != lw.desc.Digest ||
+		state.UploadID == "" || state.PartSize <= 0 {
+		log.G(lw.ctx).WithField("key", key).Warn("ecr.layer.resume: ignoring mismatched upload state")
+		return false
+	}
+	h := lw.algorithm.Hash()
+	if state.Offset > 0 {
+		unmarshaler, ok := h.(encoding.BinaryUnmarshaler)
+		if !ok || unmarshaler.UnmarshalBinary(state.DigestState) != nil {
+			log.G(lw.ctx).WithField("key", key).Warn("ecr.layer.resume: ignoring invalid digest state")
+			return false
+		}
+	}
+	lw.uploadID = state.UploadID
+	lw.partSize = state.PartSize
+	lw.startOffset = state.Offset
+	lw.acked = state.Offset
+	lw.hash = h
+	log.G(lw.ctx).
+		WithField("uploadID", state.UploadID).
+		WithField("offset", state.Offset).
+		Debug("ecr.layer.resume")
+	return true
+}
+
+// acknowledge records that Amazon ECR received the content of the layer up to
+// end, and records the new state of the upload.
+func (lw *layerWriter) acknowledge(end int64) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	lw.acked = end
+	digestState := lw.digestStates[end]
+	for offset := range lw.digestStates {
+		if offset <= end {
+			delete(lw.digestStates, offset)
+		}
+	}
+	lw.saveState(digestState)
+}
+
+// saveState records the state of the upload in the store, if there is one,
+// with digestState being the marshaled state of the hash of the acknowledged
+// content.  The caller must hold lw.lock or otherwise have exclusive access.
+// Failures are logged rather than returned since they only prevent the upload
+// from being continued later.
+func (lw *layerWriter) saveState(digestState []byte) {
+	if lw.store == nil {
+		return
+	}
+	if digestState == nil && lw.acked > 0 {
+		// the upload cannot be continued without the digest state
+		return
+	}
+	state := UploadState{
+		Registry:    lw.base.ecrSpec.Registry(),
+		Repository:  lw.base.ecrSpec.Repository,
+		Digest:      lw.desc.Digest,
+		UploadID:    lw.uploadID,
+		PartSize:    lw.partSize,
+		Offset:      lw.acked,
+		DigestState: digestState,
+		UpdatedAt:   time.Now(),
+	}
+	if err := lw.store.Put(uploadKey(lw.base.ecrSpec, lw.desc.Digest), state); err != nil {
+		log.G(lw.ctx).WithError(err).Warn("ecr.layer.state: failed to save upload state")
+	}
+}
+
+// deleteState removes the state of the upload from the store, if there is
+// one.
+func (lw *layerWriter) deleteState() {
+	if lw.store == nil {
+		return
+	}
+	if err := lw.store.Delete(uploadKey(lw.base.ecrSpec, lw.desc.Digest)); err != nil {
+		log.G(lw.ctx).WithError(err).Warn("ecr.layer.state: failed to delete upload state")
+	}
+}
+
+// addOffset records the number of bytes uploaded with the tracker.
+func (lw *layerWriter) addOffset(n int64) error {
+	status, err := lw.tracker.GetStatus(lw.ref)
+	if err != nil {
+		return err
+	}
+	status.Offset += n
+	status.UpdatedAt = time.Now()
+	lw.tracker.SetStatus(lw.ref, status)
+	return nil
 }
 
 func (lw *layerWriter) Write(b []byte) (int, error) {
 	log.G(lw.ctx).WithField("len(b)", len(b)).Debug("ecr.layer.write")
+	// the upload error takes precedence over the cancellation that follows it
 	select {
-	case err := <-lw.err:
-		return 0, err
-	case <-lw.ctx.Done():
+	case <-lw.done:
+		if lw.err != nil {
+			return 0, lw.err
+		}
 		return 0, errors.New("lw.Write: closed")
 	default:
 	}
-	return lw.buf.Write(b)
+	if err := lw.ctx.Err(); err != nil {
+		return 0, errors.Wrap(err, "lw.Write: closed")
+	}
+	lw.start()
+	n, err := lw.buf.Write(b)
+	lw.lock.Lock()
+	lw.written += int64(n)
+	lw.lock.Unlock()
+	return n, err
 }
 
+// Close abandons the upload if the writer has not been committed, stopping
+// any parts that are being uploaded.  Amazon ECR has no API to cancel an
+// upload, so the parts already received expire on their own; with an
+// UploadStore, the upload can instead be continued by a later push.  Close
+// waits for the upload to stop and can be called more than once.
 func (lw *layerWriter) Close() error {
-	return errors.New("lw.Close: not implemented")
+	log.G(lw.ctx).Debug("ecr.layer.close")
+	lw.cancel()
+	lw.buf.CloseWithError(errors.New("lw.Write: closed"))
+	lw.start()
+	<-lw.done
+	return nil
 }
 
 func (lw *layerWriter) Digest() digest.Digest {
@@ -155,17 +500,54 @@ func (lw *layerWriter) Digest() digest.Digest {
 
 func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
 	log.G(lw.ctx).WithField("size", size).WithField("expected", expected).Debug("ecr.layer.commit")
+	lw.start()
 	lw.buf.Close()
 	select {
-	case err := <-lw.err:
-		if err != nil {
+	case <-lw.done:
+		if lw.err != nil {
 			log.G(lw.ctx).
-				WithError(err).
+				WithError(lw.err).
 				WithField("expected", expected).
 				Error("ecr.layer.commit: error while uploading parts")
-			return err
+			return lw.err
 		}
-	case <-lw.ctx.Done():
+	case <-ctx.Done():
+		lw.cancel()
+		return ctx.Err()
+	}
+
+	lw.lock.Lock()
+	written := lw.startOffset + lw.written
+	lw.lock.Unlock()
+	if size > 0 && size != written {
+		log.G(lw.ctx).
+			WithField("size", size).
+			WithField("written", written).
+			Error("ecr.layer.commit: unexpected size")
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.layer.commit: unexpected commit size %d, expected %d", written, size)
+	}
+
+	// Verify the content locally before completing the upload, so that
+	// corrupted content is never committed and layers with digests that
+	// Amazon ECR does not compute itself can still be verified.
+	if err := expected.Validate(); err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.layer.commit: invalid digest %q: %v", expected, err)
+	}
+	if expected.Algorithm() != lw.algorithm {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.layer.commit: cannot verify %v digest of content hashed with %v", expected.Algorithm(), lw.algorithm)
+	}
+	lw.lock.Lock()
+	actual := digest.NewDigest(lw.algorithm, lw.hash)
+	lw.lock.Unlock()
+	if actual != expected {
+		log.G(lw.ctx).
+			WithField("expected", expected).
+			WithField("actual", actual).
+			Error("ecr.layer.commit: digest mismatch")
+		// the parts received by Amazon ECR do not make up the layer, so
+		// the upload must not be continued
+		lw.deleteState()
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.layer.commit: unexpected digest %v, expected %v", actual, expected)
 	}
 
 	completeLayerUploadInput := &ecr.CompleteLayerUploadInput{
@@ -175,23 +557,27 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 		LayerDigests:   []*string{aws.String(expected.String())},
 	}
 
-	completeLayerUploadOutput, err := lw.base.client.CompleteLayerUpload(completeLayerUploadInput)
+	completeLayerUploadOutput, err := lw.base.client.CompleteLayerUploadWithContext(ctx, completeLayerUploadInput)
 	if err != nil {
-		// If the layer that is being uploaded already exists then return successfully instead of failing. Unfortunately
-		// in this case we do not get the digest back from ECR, but if the client-provided digest starts with a
-		// "sha256:" then the ECR has validated that the digest provided matches ours. If the expected digest uses a
-		// different algorithm we have to fail as we do not know the digest ECR calculated and the expected digest
-		// has not been validated.
-		awsErr, ok := err.(awserr.Error)
-		if ok && awsErr.Code() == "LayerAlreadyExistsException" && strings.HasPrefix(expected.String(), "sha256:") {
+		// If the layer that is being uploaded already exists then return successfully instead of failing. We do not
+		// get the digest back from ECR in this case, but the content has already been verified locally against the
+		// expected digest, whatever its algorithm.
+		err = ecrerr.FromAWSError("CompleteLayerUpload", err)
+		if errdefs.IsAlreadyExists(err) {
 			log.G(lw.ctx).Debug("ecr.layer.commit: layer already exists")
+			lw.deleteState()
 			return nil
-		} else {
-			return err
 		}
+		if !errdefs.IsUnavailable(err) {
+			lw.deleteState()
+		}
+		return err
 	}
-	actualDigest := aws.StringValue(completeLayerUploadOutput.LayerDigest)
-	if actualDigest != expected.String() {
+	lw.deleteState()
+	// Amazon ECR reports the digest it computed, which can only be compared
+	// when it uses the same algorithm as the expected digest.
+	actualDigest := digest.Digest(aws.StringValue(completeLayerUploadOutput.LayerDigest))
+	if err := actualDigest.Validate(); err != nil || (actualDigest.Algorithm() == expected.Algorithm() && actualDigest != expected) {
 		return errors.New("ecr: failed to validate uploaded digest")
 	}
 	log.G(ctx).
@@ -201,16 +587,50 @@ func (lw *layerWriter) Commit(ctx context.Context, size int64, expected digest.D
 	return nil
 }
 
+// Status reports the offset of the writer.  When continuing an earlier
+// upload, the offset starts at the number of bytes already received by Amazon
+// ECR, and the content written to the writer must start at that offset.
 func (lw *layerWriter) Status() (content.Status, error) {
 	log.G(lw.ctx).Debug("ecr.layer.status")
 
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
 	return content.Status{
-		Ref: lw.desc.Digest.String(),
+		Ref:      lw.desc.Digest.String(),
+		Offset:   lw.startOffset + lw.written,
+		Total:    lw.desc.Size,
+		Expected: lw.desc.Digest,
 	}, nil
 }
 
+// Truncate discards the content received by an earlier upload so that the
+// layer can be written from the beginning.  Amazon ECR does not allow the
+// content of an upload to be removed, so a new upload is initiated.  Only
+// truncating to zero before any content has been written, or to the current
+// offset, is supported.
 func (lw *layerWriter) Truncate(size int64) error {
 	log.G(lw.ctx).WithField("size", size).Debug("ecr.layer.truncate")
 
-	return errors.New("ecr.layer.truncate: not implemented")
+	lw.lock.Lock()
+	offset, started := lw.startOffset+lw.written, lw.started
+	lw.lock.Unlock()
+	if size == offset {
+		return nil
+	}
+	if size != 0 || started {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "ecr.layer.truncate: cannot truncate to %d", size)
+	}
+	lw.deleteState()
+	if err := lw.initiate(); err != nil {
+		return err
+	}
+	// the tracker counted the content received by the earlier upload
+	status, err := lw.tracker.GetStatus(lw.ref)
+	if err != nil {
+		return err
+	}
+	status.Offset = 0
+	status.UpdatedAt = time.Now()
+	lw.tracker.SetStatus(lw.ref, status)
+	return nil
 }
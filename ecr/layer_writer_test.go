@@ -16,29 +16,40 @@
 package ecr
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding"
 	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLayerWriter(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
 	layerData := "layer"
-	layerDigest := "digest"
+	layerDigest := digest.FromString(layerData).String()
 	uploadID := "upload"
 	initiateLayerUploadCount, uploadLayerPartCount, completeLayerUploadCount := 0, 0, 0
 	client := &fakeECRClient{
-		InitiateLayerUploadFn: func(input *ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		InitiateLayerUploadFn: func(_ aws.Context, input *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
 			initiateLayerUploadCount++
 			assert.Equal(t, registry, aws.StringValue(input.RegistryId))
 			assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
@@ -48,7 +59,7 @@ func TestLayerWriter(t *testing.T) {
 				PartSize: aws.Int64(1),
 			}, nil
 		},
-		UploadLayerPartFn: func(input *ecr.UploadLayerPartInput) (*ecr.UploadLayerPartOutput, error) {
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
 			assert.Equal(t, registry, aws.StringValue(input.RegistryId))
 			assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
 			assert.Equal(t, uploadID, aws.StringValue(input.UploadId))
@@ -59,7 +70,7 @@ func TestLayerWriter(t *testing.T) {
 			uploadLayerPartCount++
 			return nil, nil
 		},
-		CompleteLayerUploadFn: func(input *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
+		CompleteLayerUploadFn: func(_ aws.Context, input *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
 			completeLayerUploadCount++
 			assert.Equal(t, registry, aws.StringValue(input.RegistryId))
 			assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
@@ -88,7 +99,8 @@ func TestLayerWriter(t *testing.T) {
 	refKey := "refKey"
 	tracker.SetStatus(refKey, docker.Status{})
 
-	lw, err := newLayerWriter(ecrBase, tracker, "refKey", desc)
+	pusher := &ecrPusher{ecrBase: *ecrBase, tracker: tracker}
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, initiateLayerUploadCount)
 	assert.Equal(t, 0, uploadLayerPartCount)
@@ -103,45 +115,726 @@ func TestLayerWriter(t *testing.T) {
 	assert.Equal(t, 1, completeLayerUploadCount)
 }
 
-type layerAlreadyExistsError struct{}
+// consecutiveParts returns an UploadLayerPart function that, like Amazon ECR,
+// rejects parts that do not start right after the last byte received for the
+// upload.  uploaded, if not nil, is called with each part that is accepted.
+func consecutiveParts(uploaded func(*ecr.UploadLayerPartInput)) func(aws.Context, *ecr.UploadLayerPartInput, ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+	var lock sync.Mutex
+	next := map[string]int64{}
+	return func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		uploadID := aws.StringValue(input.UploadId)
+		if aws.Int64Value(input.PartFirstByte) != next[uploadID] {
+			return nil, &ecr.InvalidLayerPartException{
+				LastValidByteReceived: aws.Int64(next[uploadID] - 1),
+				Message_:              aws.String("part is not consecutive"),
+				UploadId:              input.UploadId,
+			}
+		}
+		next[uploadID] = aws.Int64Value(input.PartLastByte) + 1
+		if uploaded != nil {
+			uploaded(input)
+		}
+		return &ecr.UploadLayerPartOutput{
+			LastByteReceived: input.PartLastByte,
+			UploadId:         input.UploadId,
+		}, nil
+	}
+}
 
-func (l *layerAlreadyExistsError) Code() string    { return "LayerAlreadyExistsException" }
-func (l *layerAlreadyExistsError) Error() string   { return l.Code() }
-func (l *layerAlreadyExistsError) Message() string { return l.Code() }
-func (l *layerAlreadyExistsError) OrigErr() error  { return l }
+func TestLayerWriterParallel(t *testing.T) {
+	layerData := "parallel layer"
+	var (
+		uploaded []byte
+		parts    int
+	)
+	// the first part is held until the whole layer has been written
+	firstPart := make(chan struct{})
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(2),
+			}, nil
+		},
+		UploadLayerPartFn: consecutiveParts(func(input *ecr.UploadLayerPartInput) {
+			first, last := aws.Int64Value(input.PartFirstByte), aws.Int64Value(input.PartLastByte)
+			assert.Equal(t, int(last-first+1), len(input.LayerPartBlob))
+			if first == 0 {
+				<-firstPart
+			}
+			uploaded = append(uploaded, input.LayerPartBlob...)
+			parts++
+		}),
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(digest.FromString(layerData).String()),
+			}, nil
+		},
+	}
+	desc := ocispec.Descriptor{
+		Digest: digest.FromString(layerData),
+	}
 
-var _ awserr.Error = (*layerAlreadyExistsError)(nil)
+	pusher := newTestLayerPusher(client)
+	pusher.uploadReadAhead = 6
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
+	require.NoError(t, err)
 
-func TestLayerWriterCommitExists(t *testing.T) {
-	registry := "registry"
-	repository := "repository"
-	layerDigest := "sha256:digest"
-	callCount := 0
+	// the parts after the first are read and hashed while the first part is
+	// being uploaded
+	written := make(chan error)
+	go func() {
+		_, err := lw.Write([]byte(layerData))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("parts should be read ahead of the part being uploaded")
+	}
+	// the last part is hashed once it has been read from the pipe, shortly
+	// after the write returns
+	hashed := func() int {
+		lw.(*layerWriter).lock.Lock()
+		defer lw.(*layerWriter).lock.Unlock()
+		return len(lw.(*layerWriter).digestStates)
+	}
+	for deadline := time.Now().Add(5 * time.Second); hashed() < len(layerData)/2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, len(layerData)/2, hashed(), "every part should be hashed before the first is acknowledged")
+	close(firstPart)
+
+	err = lw.Commit(context.TODO(), int64(len(layerData)), desc.Digest)
+	assert.NoError(t, err)
+	assert.Equal(t, layerData, string(uploaded))
+	assert.Equal(t, (len(layerData)+1)/2, parts)
+
+	status, err := pusher.tracker.GetStatus("refKey")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(layerData)), status.Offset)
+}
+
+func TestLayerUploadQueueSize(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		readAhead   int
+		memoryLimit int64
+		queueSize   int64
+	}{
+		{"default", 0, 0, layerQueueSize},
+		{"read ahead", 8, 0, 8},
+		{"small read ahead", 2, 0, 2},
+		{"limited", 8, 5 * 10, 3},
+		{"limit above queue", 0, 100 * 10, layerQueueSize},
+		{"two parts", 0, 2 * 10, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			queueSize, err := layerUploadQueueSize(tc.readAhead, tc.memoryLimit, 10)
+			require.NoError(t, err)
+			assert.Equal(t, tc.queueSize, queueSize)
+		})
+	}
+
+	_, err := layerUploadQueueSize(0, 19, 10)
+	assert.True(t, errdefs.IsInvalidArgument(err), "a limit smaller than two parts should be rejected: %v", err)
+}
+
+func TestLayerWriterMemoryLimit(t *testing.T) {
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+	}
+	pusher := newTestLayerPusher(client)
+	pusher.uploadMemoryLimit = 1
+	_, err := newLayerWriter(context.Background(), pusher, "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")})
+	assert.True(t, errdefs.IsInvalidArgument(err), "a limit smaller than two parts should be rejected: %v", err)
+
+	resolver, err := NewResolver(WithLayerUploadMemoryLimit(-1))
+	assert.Error(t, err)
+	assert.Nil(t, resolver)
+}
+
+func TestLayerWriterRetryPart(t *testing.T) {
+	layerData := "layer"
+	attempts := map[int64]int{}
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(1),
+			}, nil
+		},
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			first := aws.Int64Value(input.PartFirstByte)
+			attempts[first]++
+			// every part is throttled once before succeeding
+			if attempts[first] == 1 {
+				return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+			}
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(digest.FromString(layerData).String()),
+			}, nil
+		},
+	}
+	ecrBase := &ecrBase{
+		client: client,
+		ecrSpec: ECRSpec{
+			arn: arn.ARN{
+				AccountID: "registry",
+			},
+			Repository: "repository",
+		},
+	}
+	desc := ocispec.Descriptor{
+		Digest: digest.FromString(layerData),
+	}
+
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+
+	pusher := &ecrPusher{ecrBase: *ecrBase, tracker: tracker, retryPolicy: RetryPolicy{MaxAttempts: 2}}
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
+	assert.NoError(t, err)
+
+	_, err = lw.Write([]byte(layerData))
+	assert.NoError(t, err)
+	err = lw.Commit(context.TODO(), int64(len(layerData)), desc.Digest)
+	assert.NoError(t, err)
+	assert.Len(t, attempts, len(layerData))
+	for first, count := range attempts {
+		assert.Equal(t, 2, count, "part at %d", first)
+	}
+}
+
+func TestLayerWriterRetryReceivedPart(t *testing.T) {
+	layerData := "layer"
+	attempts := map[int64]int{}
+	upload := consecutiveParts(nil)
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+		UploadLayerPartFn: func(ctx aws.Context, input *ecr.UploadLayerPartInput, opts ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			first := aws.Int64Value(input.PartFirstByte)
+			attempts[first]++
+			output, err := upload(ctx, input, opts...)
+			// the first attempt of every part is received, but its
+			// response is lost
+			if attempts[first] == 1 {
+				require.NoError(t, err)
+				return nil, awserr.New(ecr.ErrCodeServerException, "response lost", nil)
+			}
+			return output, err
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(digest.FromString(layerData).String()),
+			}, nil
+		},
+	}
+	desc := ocispec.Descriptor{
+		Digest: digest.FromString(layerData),
+	}
+
+	pusher := newTestLayerPusher(client)
+	pusher.retryPolicy = RetryPolicy{MaxAttempts: 2}
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
+	require.NoError(t, err)
+
+	_, err = lw.Write([]byte(layerData))
+	assert.NoError(t, err)
+	err = lw.Commit(context.TODO(), int64(len(layerData)), desc.Digest)
+	assert.NoError(t, err, "retried parts that were received should be acknowledged")
+	for first, count := range attempts {
+		assert.Equal(t, 2, count, "part %d should be uploaded twice", first)
+	}
+
+	status, err := pusher.tracker.GetStatus("refKey")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(layerData)), status.Offset)
+}
+
+func TestLayerWriterResumeReceivedPart(t *testing.T) {
+	layerData := []byte("resumable layer")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(layerData),
+		Size:   int64(len(layerData)),
+	}
+	dir, err := ioutil.TempDir("", "ecr-upload-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileUploadStore(dir)
+	require.NoError(t, err)
+
+	var firstBytes []int64
+	upload := consecutiveParts(func(input *ecr.UploadLayerPartInput) {
+		firstBytes = append(firstBytes, aws.Int64Value(input.PartFirstByte))
+	})
+	// Amazon ECR received the first two parts of the upload, but only the
+	// first was recorded in the store
+	for _, first := range []int64{0, 3} {
+		_, err := upload(context.Background(), &ecr.UploadLayerPartInput{
+			UploadId:      aws.String("upload"),
+			PartFirstByte: aws.Int64(first),
+			PartLastByte:  aws.Int64(first + 2),
+		})
+		require.NoError(t, err)
+	}
+	firstBytes = nil
+	client := &fakeECRClient{
+		UploadLayerPartFn: upload,
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(desc.Digest.String()),
+			}, nil
+		},
+	}
+	pusher := newTestLayerPusher(client)
+	pusher.uploadStore = store
+	h := sha256.New()
+	h.Write(layerData[:3])
+	digestState, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, store.Put(uploadKey(pusher.ecrSpec, desc.Digest), UploadState{
+		Registry:    "registry",
+		Repository:  "repository",
+		Digest:      desc.Digest,
+		UploadID:    "upload",
+		PartSize:    3,
+		Offset:      3,
+		DigestState: digestState,
+	}))
+
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
+	require.NoError(t, err)
+	err = content.Copy(context.Background(), lw, bytes.NewReader(layerData), desc.Size, desc.Digest)
+	assert.NoError(t, err, "the part received but not recorded should be acknowledged")
+	assert.Equal(t, []int64{6, 9, 12}, firstBytes)
+}
+
+func TestLayerWriterResume(t *testing.T) {
+	layerData := []byte("resumable layer")
+	desc := ocispec.Descriptor{
+		Digest: digest.FromBytes(layerData),
+		Size:   int64(len(layerData)),
+	}
+	dir, err := ioutil.TempDir("", "ecr-upload-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileUploadStore(dir)
+	require.NoError(t, err)
+
+	initiateCount := 0
+	var firstBytes []int64
+	failAt := int64(12)
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			initiateCount++
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(3),
+			}, nil
+		},
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			assert.Equal(t, "upload", aws.StringValue(input.UploadId))
+			first := aws.Int64Value(input.PartFirstByte)
+			if first == failAt {
+				return nil, awserr.New("InvalidParameterException", "simulated failure", nil)
+			}
+			firstBytes = append(firstBytes, first)
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			return &ecr.CompleteLayerUploadOutput{
+				LayerDigest: aws.String(desc.Digest.String()),
+			}, nil
+		},
+	}
+	newPusher := func() *ecrPusher {
+		tracker := docker.NewInMemoryTracker()
+		tracker.SetStatus("refKey", docker.Status{})
+		return &ecrPusher{
+			ecrBase: ecrBase{
+				client: client,
+				ecrSpec: ECRSpec{
+					arn: arn.ARN{
+						AccountID: "registry",
+					},
+					Repository: "repository",
+				},
+			},
+			tracker:     tracker,
+			uploadStore: store,
+		}
+	}
+
+	// the first push fails on the last part, after four parts are
+	// acknowledged
+	lw, err := newLayerWriter(context.Background(), newPusher(), "refKey", desc)
+	require.NoError(t, err)
+	err = content.Copy(context.Background(), lw, bytes.NewReader(layerData), desc.Size, desc.Digest)
+	assert.Error(t, err)
+	assert.Equal(t, []int64{0, 3, 6, 9}, firstBytes)
+
+	state, err := store.Get(uploadKey(newPusher().ecrSpec, desc.Digest))
+	require.NoError(t, err)
+	assert.Equal(t, "upload", state.UploadID)
+	assert.Equal(t, int64(12), state.Offset)
+
+	// the second push continues the same upload
+	failAt = -1
+	firstBytes = nil
+	lw, err = newLayerWriter(context.Background(), newPusher(), "refKey", desc)
+	require.NoError(t, err)
+	assert.Equal(t, 1, initiateCount, "the upload should be continued")
+	status, err := lw.Status()
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), status.Offset)
+
+	err = content.Copy(context.Background(), lw, bytes.NewReader(layerData), desc.Size, desc.Digest)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{12}, firstBytes)
+	assert.Equal(t, desc.Digest, digest.NewDigest(desc.Digest.Algorithm(), lw.(*layerWriter).hash))
+
+	_, err = store.Get(uploadKey(newPusher().ecrSpec, desc.Digest))
+	assert.True(t, errdefs.IsNotFound(err), "upload state should be removed after commit")
+}
+
+func TestLayerWriterTruncate(t *testing.T) {
+	uploadIDs := []string{"first", "second"}
+	initiateCount := 0
+	var firstBytes []int64
 	client := &fakeECRClient{
-		CompleteLayerUploadFn: func(_ *ecr.CompleteLayerUploadInput) (*ecr.CompleteLayerUploadOutput, error) {
-			callCount++
-			return nil, &layerAlreadyExistsError{}
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			uploadID := uploadIDs[initiateCount]
+			initiateCount++
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String(uploadID),
+				PartSize: aws.Int64(3),
+			}, nil
+		},
+		UploadLayerPartFn: func(_ aws.Context, input *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			assert.Equal(t, "first", aws.StringValue(input.UploadId), "parts should be uploaded to the new upload")
+			firstBytes = append(firstBytes, aws.Int64Value(input.PartFirstByte))
+			return &ecr.UploadLayerPartOutput{}, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, input *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			assert.Equal(t, "first", aws.StringValue(input.UploadId))
+			return &ecr.CompleteLayerUploadOutput{LayerDigest: aws.String(digest.FromString("layer").String())}, nil
+		},
+	}
+	dir, err := ioutil.TempDir("", "ecr-upload-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileUploadStore(dir)
+	require.NoError(t, err)
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+			},
 		},
+		tracker:     tracker,
+		uploadStore: store,
+	}
+	desc := ocispec.Descriptor{
+		Digest: digest.FromString("layer"),
+	}
+	h := sha256.New()
+	h.Write([]byte("lay"))
+	digestState, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	require.NoError(t, err)
+	key := uploadKey(pusher.ecrSpec, desc.Digest)
+	require.NoError(t, store.Put(key, UploadState{
+		Registry:    "registry",
+		Repository:  "repository",
+		Digest:      desc.Digest,
+		UploadID:    "expired",
+		PartSize:    3,
+		Offset:      3,
+		DigestState: digestState,
+	}))
+
+	lw, err := newLayerWriter(context.Background(), pusher, "refKey", desc)
+	require.NoError(t, err)
+	assert.Equal(t, 0, initiateCount)
+	assert.NoError(t, lw.Truncate(3), "truncating to the current offset is a no-op")
+	assert.Error(t, lw.Truncate(2))
+
+	trackerStatus, err := tracker.GetStatus("refKey")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), trackerStatus.Offset)
+
+	assert.NoError(t, lw.Truncate(0))
+	assert.Equal(t, 1, initiateCount)
+	assert.Equal(t, "first", lw.(*layerWriter).uploadID)
+	state, err := store.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, "first", state.UploadID)
+	status, err := lw.Status()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), status.Offset)
+	trackerStatus, err = tracker.GetStatus("refKey")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), trackerStatus.Offset, "the tracker should agree with Status after a truncate")
+
+	// the layer is uploaded from the beginning, and cannot be truncated
+	// once parts are being uploaded
+	_, err = lw.Write([]byte("layer"))
+	require.NoError(t, err)
+	assert.True(t, errdefs.IsNotImplemented(lw.Truncate(0)), "truncating a started upload should fail")
+	require.NoError(t, lw.Commit(context.Background(), 5, digest.FromString("layer")))
+	assert.Equal(t, []int64{0, 3}, firstBytes)
+	trackerStatus, err = tracker.GetStatus("refKey")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), trackerStatus.Offset)
+}
+
+func TestLayerWriterCancel(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{
+				UploadId: aws.String("upload"),
+				PartSize: aws.Int64(1),
+			}, nil
+		},
+		UploadLayerPartFn: func(ctx aws.Context, _ *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			// block the part until the push is canceled
+			close(started)
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		},
+	}
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+			},
+		},
+		tracker: tracker,
 	}
 
-	_, writer := io.Pipe()
 	ctx, cancel := context.WithCancel(context.Background())
+	lw, err := newLayerWriter(ctx, pusher, "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")})
+	require.NoError(t, err)
+
+	writeErr := make(chan error)
+	go func() {
+		// the writes block once the part queue is full
+		_, err := lw.Write(make([]byte, 100))
+		writeErr <- err
+	}()
+	<-started
 	cancel()
-	lw := layerWriter{
-		base: &ecrBase{
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight part was not canceled")
+	}
+	select {
+	case err := <-writeErr:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked write was not released")
+	}
+	err = lw.Commit(context.Background(), 100, digest.FromString("layer"))
+	assert.Error(t, err)
+}
+
+// newTestLayerPusher returns a pusher for a single repository backed by
+// client, with the "refKey" status being tracked.
+func newTestLayerPusher(client *fakeECRClient) *ecrPusher {
+	tracker := docker.NewInMemoryTracker()
+	tracker.SetStatus("refKey", docker.Status{})
+	return &ecrPusher{
+		ecrBase: ecrBase{
 			client: client,
 			ecrSpec: ECRSpec{
 				arn: arn.ARN{
-					AccountID: registry,
+					AccountID: "registry",
 				},
-				Repository: repository,
+				Repository: "repository",
 			},
 		},
-		buf: writer,
-		ctx: ctx,
+		tracker: tracker,
 	}
+}
 
-	err := lw.Commit(context.Background(), 0, digest.Digest(layerDigest))
-	assert.NoError(t, err)
-	assert.Equal(t, 1, callCount)
+func initiateLayerUploadFn(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+	return &ecr.InitiateLayerUploadOutput{
+		UploadId: aws.String("upload"),
+		PartSize: aws.Int64(1),
+	}, nil
+}
+
+func TestLayerWriterUploadFailure(t *testing.T) {
+	uploadErr := awserr.New("InvalidParameterException", "simulated failure", nil)
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+		UploadLayerPartFn: func(_ aws.Context, _ *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return nil, uploadErr
+		},
+	}
+	lw, err := newLayerWriter(context.Background(), newTestLayerPusher(client), "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")})
+	require.NoError(t, err)
+
+	// far more parts than can be queued, so the write blocks on the pipe
+	// once the upload has failed
+	writeErr := make(chan error)
+	go func() {
+		_, err := lw.Write(make([]byte, 100))
+		writeErr <- err
+	}()
+	select {
+	case err := <-writeErr:
+		assert.True(t, errdefs.IsInvalidArgument(err), "write should fail with the upload error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not released after the upload failed")
+	}
+
+	_, err = lw.Write([]byte("more"))
+	assert.True(t, errdefs.IsInvalidArgument(err), "later writes should fail with the upload error: %v", err)
+	err = lw.Commit(context.Background(), 104, digest.FromString("layer"))
+	assert.True(t, errdefs.IsInvalidArgument(err), "commit should fail with the upload error: %v", err)
+}
+
+func TestLayerWriterClose(t *testing.T) {
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+		UploadLayerPartFn: func(_ aws.Context, _ *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			t.Fatal("abandoned upload should not be completed")
+			return nil, nil
+		},
+	}
+	lw, err := newLayerWriter(context.Background(), newTestLayerPusher(client), "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")})
+	require.NoError(t, err)
+
+	_, err = lw.Write([]byte("layer"))
+	require.NoError(t, err)
+	assert.NoError(t, lw.Close())
+	assert.NoError(t, lw.Close(), "closing twice should succeed")
+
+	_, err = lw.Write([]byte("more"))
+	assert.Error(t, err)
+	err = lw.Commit(context.Background(), 5, digest.FromString("layer"))
+	assert.Error(t, err)
+}
+
+func TestLayerWriterCommitSizeMismatch(t *testing.T) {
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+		UploadLayerPartFn: func(_ aws.Context, _ *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			t.Fatal("upload of unexpected size should not be completed")
+			return nil, nil
+		},
+	}
+	lw, err := newLayerWriter(context.Background(), newTestLayerPusher(client), "refKey", ocispec.Descriptor{Digest: digest.FromString("layer")})
+	require.NoError(t, err)
+
+	_, err = lw.Write([]byte("layer"))
+	require.NoError(t, err)
+	err = lw.Commit(context.Background(), 6, digest.FromString("layer"))
+	assert.True(t, errdefs.IsFailedPrecondition(err), "commit should fail with a size mismatch: %v", err)
+}
+
+type layerAlreadyExistsError struct{}
+
+func (l *layerAlreadyExistsError) Code() string    { return "LayerAlreadyExistsException" }
+func (l *layerAlreadyExistsError) Error() string   { return l.Code() }
+func (l *layerAlreadyExistsError) Message() string { return l.Code() }
+func (l *layerAlreadyExistsError) OrigErr() error  { return l }
+
+var _ awserr.Error = (*layerAlreadyExistsError)(nil)
+
+func TestLayerWriterCommitExists(t *testing.T) {
+	registry := "registry"
+	repository := "repository"
+	// the content is verified locally, so existing layers are accepted
+	// whatever the digest algorithm
+	for _, algorithm := range []digest.Algorithm{digest.SHA256, digest.SHA384, digest.SHA512} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			callCount := 0
+			client := &fakeECRClient{
+				CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+					callCount++
+					return nil, &layerAlreadyExistsError{}
+				},
+			}
+
+			_, writer := io.Pipe()
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			done := make(chan struct{})
+			close(done)
+			lw := layerWriter{
+				base: &ecrBase{
+					client: client,
+					ecrSpec: ECRSpec{
+						arn: arn.ARN{
+							AccountID: registry,
+						},
+						Repository: repository,
+					},
+				},
+				buf:       writer,
+				ctx:       ctx,
+				done:      done,
+				algorithm: algorithm,
+				hash:      algorithm.Hash(),
+			}
+			// the parts have all been uploaded
+			lw.startOnce.Do(func() {})
+
+			err := lw.Commit(context.Background(), 0, algorithm.FromBytes(nil))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, callCount)
+		})
+	}
+}
+
+func TestLayerWriterCommitDigestMismatch(t *testing.T) {
+	client := &fakeECRClient{
+		InitiateLayerUploadFn: initiateLayerUploadFn,
+		UploadLayerPartFn: func(_ aws.Context, _ *ecr.UploadLayerPartInput, _ ...request.Option) (*ecr.UploadLayerPartOutput, error) {
+			return nil, nil
+		},
+		CompleteLayerUploadFn: func(_ aws.Context, _ *ecr.CompleteLayerUploadInput, _ ...request.Option) (*ecr.CompleteLayerUploadOutput, error) {
+			t.Fatal("corrupted upload should not be completed")
+			return nil, nil
+		},
+	}
+	expected := digest.SHA512.FromString("layer")
+	lw, err := newLayerWriter(context.Background(), newTestLayerPusher(client), "refKey", ocispec.Descriptor{Digest: expected})
+	require.NoError(t, err)
+
+	_, err = lw.Write([]byte("corrupted"))
+	require.NoError(t, err)
+	err = lw.Commit(context.Background(), 9, expected)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "commit should fail with a digest mismatch: %v", err)
 }
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Lockfile pins tagged refs to digests.  Refs are stored in the canonical
+// form returned by ECRSpec.Canonical, such as
+// "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest", so
+// that the same tag matches whichever form it is referred to by.
+type Lockfile struct {
+	Images map[string]digest.Digest `json:"images"`
+}
+
+// ReadLockfile reads a lockfile in JSON form from r.
+func ReadLockfile(r io.Reader) (*Lockfile, error) {
+	lockfile := &Lockfile{}
+	if err := json.NewDecoder(r).Decode(lockfile); err != nil {
+		return nil, errors.Wrap(err, "ecr.lockfile: invalid lockfile")
+	}
+	if lockfile.Images == nil {
+		lockfile.Images = map[string]digest.Digest{}
+	}
+	for ref, dgst := range lockfile.Images {
+		if err := dgst.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "ecr.lockfile: invalid digest for %s", ref)
+		}
+	}
+	return lockfile, nil
+}
+
+// LoadLockfile reads the lockfile at path.
+func LoadLockfile(path string) (*Lockfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLockfile(f)
+}
+
+// Write writes the lockfile in JSON form to w.  Refs are written in sorted
+// order so that the output is stable.
+func (l *Lockfile) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(l)
+}
+
+// lockfileMode is the mode of lockfiles created by Save.
+const lockfileMode = 0644
+
+// Save writes the lockfile to path, replacing it atomically.  An existing
+// lockfile keeps its mode; a new one is created with mode 0644.
+func (l *Lockfile) Save(path string) error {
+	mode := os.FileMode(lockfileMode)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := l.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Pin records that ref resolves to dgst.  ref must include a tag and no
+// digest.
+func (l *Lockfile) Pin(ref string, dgst digest.Digest) error {
+	key, err := lockfileKey(ref)
+	if err != nil {
+		return err
+	}
+	if err := dgst.Validate(); err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.lockfile: invalid digest %q: %v", dgst, err)
+	}
+	if l.Images == nil {
+		l.Images = map[string]digest.Digest{}
+	}
+	l.Images[key] = dgst
+	return nil
+}
+
+// lockfileKey returns the key of the tagged ref in a lockfile.
+func lockfileKey(ref string) (string, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	tag, dgst := ecrSpec.TagDigest()
+	if tag == "" || dgst != "" {
+		return "", errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.lockfile: %s is not a tag reference", ref)
+	}
+	return ecrSpec.Canonical(), nil
+}
+
+type lockedResolver struct {
+	remotes.Resolver
+	lockfile *Lockfile
+}
+
+// NewLockedResolver returns a remotes.Resolver that enforces the digests
+// pinned in lockfile.  A tagged ref is resolved with resolver together with its
+// pinned digest, as "<tag>@<digest>", so that Amazon ECR looks the image up by
+// digest and checks that the tag still points at it in a single request, and
+// so that a resolver whose Policy has RequireDigest accepts it.  Resolve fails
+// with errdefs.ErrFailedPrecondition if the tag is not pinned or if Amazon ECR
+// resolves it to a different digest.  The name returned by Resolve includes
+// the pinned digest, so content is fetched by digest.  Refs that include a
+// digest are resolved without consulting the lockfile.  Fetcher and Pusher are
+// passed through to resolver.
+func NewLockedResolver(resolver remotes.Resolver, lockfile *Lockfile) remotes.Resolver {
+	return &lockedResolver{Resolver: resolver, lockfile: lockfile}
+}
+
+func (r *lockedResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	tag, dgst := ecrSpec.TagDigest()
+	if tag == "" || dgst != "" {
+		return r.Resolver.Resolve(ctx, ref)
+	}
+	pinned, ok := r.lockfile.Images[ecrSpec.Canonical()]
+	if !ok {
+		return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.lockfile: %s is not pinned", ecrSpec.Canonical())
+	}
+	ecrSpec.Object = tag + "@" + pinned.String()
+	name, desc, err := r.Resolver.Resolve(ctx, ecrSpec.name(ref))
+	if err != nil {
+		if errdefs.IsFailedPrecondition(err) {
+			return "", ocispec.Descriptor{}, errors.Wrapf(err, "ecr.lockfile: %s no longer resolves to pinned %v", ref, pinned)
+		}
+		return "", ocispec.Descriptor{}, err
+	}
+	if desc.Digest != pinned {
+		return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrFailedPrecondition,
+			"ecr.lockfile: %s resolved to %v, but is pinned to %v", ecrSpec.Canonical(), desc.Digest, pinned)
+	}
+	log.G(ctx).
+		WithField("ref", ecrSpec.Canonical()).
+		WithField("digest", pinned).
+		Debug("ecr.lockfile: resolved pinned tag")
+	return name, desc, nil
+}
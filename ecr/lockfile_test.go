@@ -0,0 +1,184 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver resolves every ref to the same digest and size.
+type fakeResolver struct {
+	remotes.Resolver
+	digest digest.Digest
+	size   int64
+	refs   []string
+}
+
+func (r *fakeResolver) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	r.refs = append(r.refs, ref)
+	return ref, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: r.digest, Size: r.size}, nil
+}
+
+func TestLockfileRoundTrip(t *testing.T) {
+	lockfile := &Lockfile{}
+	dgst := digest.FromString("manifest")
+	require.NoError(t, lockfile.Pin("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest", dgst))
+	assert.Error(t, lockfile.Pin("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar@"+dgst.String(), dgst),
+		"digest refs cannot be pinned")
+	assert.Error(t, lockfile.Pin("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest", "invalid"),
+		"invalid digests cannot be pinned")
+
+	var buf bytes.Buffer
+	require.NoError(t, lockfile.Write(&buf))
+	read, err := ReadLockfile(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, lockfile, read)
+
+	_, err = ReadLockfile(bytes.NewBufferString(`{"images": {"ref": "invalid"}}`))
+	assert.Error(t, err)
+}
+
+func TestLockfileSaveMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecr-lockfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "images.lock")
+
+	lockfile := &Lockfile{}
+	require.NoError(t, lockfile.Pin("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest", digest.FromString("manifest")))
+
+	require.NoError(t, lockfile.Save(path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "new lockfiles should be created with mode 0644")
+
+	require.NoError(t, os.Chmod(path, 0664))
+	require.NoError(t, lockfile.Save(path))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0664), info.Mode().Perm(), "existing lockfiles should keep their mode")
+
+	loaded, err := LoadLockfile(path)
+	require.NoError(t, err)
+	assert.Equal(t, lockfile, loaded)
+}
+
+func TestLockedResolver(t *testing.T) {
+	const ref = "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest"
+	pinned := digest.FromString("pinned manifest")
+	current := digest.FromString("current manifest")
+	lockfile := &Lockfile{}
+	require.NoError(t, lockfile.Pin(ref, pinned))
+
+	t.Run("pinned", func(t *testing.T) {
+		resolver := NewLockedResolver(&fakeResolver{digest: pinned}, lockfile)
+		name, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		assert.Equal(t, ref+"@"+pinned.String(), name)
+		assert.Equal(t, pinned, desc.Digest)
+	})
+
+	t.Run("resolves pinned digest", func(t *testing.T) {
+		inner := &fakeResolver{digest: pinned}
+		resolver := NewLockedResolver(inner, lockfile)
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		assert.Equal(t, []string{ref + "@" + pinned.String()}, inner.refs,
+			"the tag should be resolved together with its pinned digest")
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		resolver := NewLockedResolver(&fakeResolver{digest: current}, lockfile)
+		_, _, err := resolver.Resolve(context.Background(), ref)
+		assert.True(t, errdefs.IsFailedPrecondition(err), "expected a failed precondition: %v", err)
+	})
+
+	t.Run("not pinned", func(t *testing.T) {
+		inner := &fakeResolver{digest: current}
+		resolver := NewLockedResolver(inner, lockfile)
+		_, _, err := resolver.Resolve(context.Background(), "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:other")
+		assert.True(t, errdefs.IsFailedPrecondition(err), "expected a failed precondition: %v", err)
+		assert.Empty(t, inner.refs, "unpinned tags should not be resolved")
+	})
+
+	t.Run("digest ref", func(t *testing.T) {
+		inner := &fakeResolver{digest: current}
+		resolver := NewLockedResolver(inner, lockfile)
+		digestRef := "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar@" + current.String()
+		name, _, err := resolver.Resolve(context.Background(), digestRef)
+		require.NoError(t, err)
+		assert.Equal(t, digestRef, name)
+		assert.Equal(t, []string{digestRef}, inner.refs)
+	})
+}
+
+func TestLockedResolverRequireDigest(t *testing.T) {
+	const ref = "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	pinned := digest.FromString(imageManifest)
+	lockfile := &Lockfile{}
+	require.NoError(t, lockfile.Pin(ref, pinned))
+
+	var failure *ecr.ImageFailure
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			assert.Equal(t, []*ecr.ImageIdentifier{{
+				ImageTag:    aws.String("latest"),
+				ImageDigest: aws.String(pinned.String()),
+			}}, input.ImageIds)
+			if failure != nil {
+				return &ecr.BatchGetImageOutput{Failures: []*ecr.ImageFailure{failure}}, nil
+			}
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(pinned.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	resolver := NewLockedResolver(&ecrResolver{
+		clients: map[string]ECRClient{
+			"us-west-2": fakeClient,
+		},
+		policy: &Policy{RequireDigest: true},
+	}, lockfile)
+
+	name, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref+"@"+pinned.String(), name)
+	assert.Equal(t, pinned, desc.Digest)
+
+	failure = &ecr.ImageFailure{
+		FailureCode:   aws.String(ecr.ImageFailureCodeImageTagDoesNotMatchDigest),
+		FailureReason: aws.String("tag does not match digest"),
+	}
+	_, _, err = resolver.Resolve(context.Background(), ref)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "expected a failed precondition: %v", err)
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/remotes/docker"
@@ -37,6 +38,12 @@ type manifestWriter struct {
 	buf     bytes.Buffer
 	tracker docker.StatusTracker
 	ref     string
+	// child is set for manifests referenced from an index being pushed,
+	// which are pushed untagged.
+	child bool
+	// childManifests is released for the children of an index once the
+	// index has been committed.
+	childManifests *childManifests
 }
 
 var _ content.Writer = (*manifestWriter)(nil)
@@ -59,17 +66,28 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 	manifest := mw.buf.String()
 	log.G(mw.ctx).WithField("manifest", manifest).Debug("ecr.manifest.commit")
 	ecrSpec := mw.base.ecrSpec
-	tag, _ := ecrSpec.TagDigest()
+	// whether or not the push succeeds, the children of an index are no
+	// longer being pushed
+	defer mw.childManifests.releaseIndex(ecrSpec.ARN(), mw.desc.Digest)
 	putImageInput := &ecr.PutImageInput{
 		RegistryId:     aws.String(ecrSpec.Registry()),
 		RepositoryName: aws.String(ecrSpec.Repository),
-		ImageTag:       aws.String(tag),
 		ImageManifest:  aws.String(manifest),
 	}
+	// Manifests referenced from an index are pushed untagged; the tag is
+	// applied when the index itself is pushed.  Manifests with a subject,
+	// such as signatures, are found through the referrers index, and are
+	// pushed untagged so that they do not take the tag from the image.
+	parsed, parseErr := parseReferrerManifest(ctx, manifest)
+	if !mw.child && (parseErr != nil || parsed.Subject == nil) {
+		tag, _ := ecrSpec.TagDigest()
+		putImageInput.ImageTag = aws.String(tag)
+	}
 
 	output, err := mw.base.client.PutImageWithContext(ctx, putImageInput)
 	if err != nil {
-		return errors.Wrapf(err, "ecr: failed to put manifest: %v", ecrSpec)
+		log.G(mw.ctx).WithError(err).WithField("ref", ecrSpec.Canonical()).Error("ecr.manifest.commit: failed to put manifest")
+		return ecrerr.FromAWSError("PutImage", err)
 	}
 
 	status, err := mw.tracker.GetStatus(mw.ref)
@@ -88,6 +106,20 @@ func (mw *manifestWriter) Commit(ctx context.Context, size int64, expected diges
 	if actual != expected.String() {
 		return errors.Errorf("got digest %s, expected %s", actual, expected)
 	}
+
+	// Amazon ECR does not index referrers, so record manifests with a
+	// subject in the index of the referrers tag schema.  The manifest has
+	// already been pushed, and Referrers and signature verifiers still find
+	// it by scanning untagged images, so a failure to update the index does
+	// not fail the push.
+	if parseErr == nil && parsed.Subject != nil {
+		if err := mw.base.addReferrer(ctx, parsed, manifest); err != nil {
+			log.G(mw.ctx).
+				WithError(err).
+				WithField("subject", parsed.Subject.Digest).
+				Warn("ecr.manifest.commit: failed to update referrers index")
+		}
+	}
 	return nil
 }
 
@@ -25,6 +25,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -78,3 +79,52 @@ func TestManifestWriterCommit(t *testing.T) {
 	assert.NoError(t, err, "failed to commit")
 	assert.Equal(t, 1, callCount, "PutImage should be called once")
 }
+
+func TestManifestWriterCommitChildUntagged(t *testing.T) {
+	manifestContent := "manifest content"
+	registry := "registry"
+	repository := "repository"
+	imageTag := "tag"
+	imageDigest := "digest"
+	refKey := "refKey"
+	callCount := 0
+	client := &fakeECRClient{
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			callCount++
+			assert.Equal(t, registry, aws.StringValue(input.RegistryId))
+			assert.Equal(t, repository, aws.StringValue(input.RepositoryName))
+			assert.Nil(t, input.ImageTag, "child manifests should not be tagged")
+			assert.Equal(t, manifestContent, aws.StringValue(input.ImageManifest))
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest)}},
+			}, nil
+		},
+	}
+	mw := &manifestWriter{
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: registry,
+				},
+				Repository: repository,
+				Object:     imageTag,
+			},
+		},
+		desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.Digest(imageDigest),
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ref:     refKey,
+		ctx:     context.Background(),
+		child:   true,
+	}
+
+	_, err := mw.Write([]byte(manifestContent))
+	assert.NoError(t, err, "failed to write to manifest writer")
+
+	err = mw.Commit(context.Background(), int64(len(manifestContent)), digest.Digest(imageDigest))
+	assert.NoError(t, err, "failed to commit")
+	assert.Equal(t, 1, callCount, "PutImage should be called once")
+}
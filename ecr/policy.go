@@ -0,0 +1,158 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
+)
+
+// PolicyOperation is an operation checked by a Policy.
+type PolicyOperation string
+
+const (
+	// PolicyOperationPull covers Resolve, Fetcher, and Referrers.
+	PolicyOperationPull PolicyOperation = "pull"
+	// PolicyOperationPush covers Pusher.
+	PolicyOperationPush PolicyOperation = "push"
+)
+
+// Policy restricts the repositories that the resolver may pull from or push
+// to.  A ref is denied if it matches any Deny rule, or if there are Allow
+// rules and it matches none of them.
+type Policy struct {
+	// Allow lists the refs that are allowed.  If empty, every ref that is
+	// not denied is allowed.
+	Allow []PolicyRule
+	// Deny lists the refs that are denied, even if they are allowed.
+	Deny []PolicyRule
+	// RequireDigest denies pulls of refs that do not include a digest, so
+	// that only immutable references can be pulled.  Pushes are not
+	// affected, as refs with a digest cannot be pushed.
+	RequireDigest bool
+}
+
+// PolicyRule matches refs by the fields of their ECRSpec.  Empty fields match
+// any value.
+type PolicyRule struct {
+	// Partition is the AWS partition, such as "aws".
+	Partition string
+	// Account is the AWS account ID of the registry.
+	Account string
+	// Region is the AWS region of the registry.
+	Region string
+	// RepositoryPrefix matches repositories whose names start with it.  End
+	// the prefix with "/" to match the repositories in a namespace only.
+	RepositoryPrefix string
+	// Operations lists the operations the rule applies to.  If empty, the
+	// rule applies to all operations.
+	Operations []PolicyOperation
+}
+
+// PolicyError is returned when the policy of the resolver denies an
+// operation.  errors.Cause returns ecrerr.ErrAccessDenied for a PolicyError,
+// and IsPolicyDenied can be used to tell it apart from other access denied
+// errors.
+type PolicyError struct {
+	// Ref is the canonical ref that was denied.
+	Ref string
+	// Operation is the operation that was denied.
+	Operation PolicyOperation
+	// Reason describes why the operation was denied.
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("ecr: policy denies %s of %s: %s", e.Operation, e.Ref, e.Reason)
+}
+
+// Cause returns ecrerr.ErrAccessDenied so that errors.Cause classifies the
+// error.
+func (e *PolicyError) Cause() error {
+	return ecrerr.ErrAccessDenied
+}
+
+// Is reports whether target is ecrerr.ErrAccessDenied.
+func (e *PolicyError) Is(target error) bool {
+	return target == ecrerr.ErrAccessDenied
+}
+
+// IsPolicyDenied reports whether err, or any error it wraps, is a
+// PolicyError.
+func IsPolicyDenied(err error) bool {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if _, ok := err.(*PolicyError); ok {
+			return true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// check returns a PolicyError if the policy denies op on the ref described by
+// spec.
+func (p *Policy) check(spec ECRSpec, op PolicyOperation) error {
+	deny := func(reason string) error {
+		return &PolicyError{Ref: spec.Canonical(), Operation: op, Reason: reason}
+	}
+	if op == PolicyOperationPull && p.RequireDigest {
+		if _, dgst := spec.TagDigest(); dgst == "" {
+			return deny("a digest reference is required")
+		}
+	}
+	for _, rule := range p.Deny {
+		if rule.matches(spec, op) {
+			return deny("matches a deny rule")
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if rule.matches(spec, op) {
+			return nil
+		}
+	}
+	return deny("does not match an allow rule")
+}
+
+func (r PolicyRule) matches(spec ECRSpec, op PolicyOperation) bool {
+	if len(r.Operations) > 0 {
+		found := false
+		for _, ruleOp := range r.Operations {
+			if ruleOp == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return (r.Partition == "" || r.Partition == spec.Partition()) &&
+		(r.Account == "" || r.Account == spec.Registry()) &&
+		(r.Region == "" || r.Region == spec.Region()) &&
+		strings.HasPrefix(spec.Repository, r.RepositoryPrefix)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	const (
+		tagRef    = "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/prod/app:latest"
+		digestRef = "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/prod/app@sha256:4e07408562bedb8b60ce05c1decfe3ad16b72230967de01f640b7e4729b49fce"
+		otherRef  = "ecr.aws/arn:aws:ecr:us-east-1:210987654321:repository/dev/app:latest"
+	)
+	prod := PolicyRule{Account: "123456789012", Region: "us-west-2", RepositoryPrefix: "prod/"}
+
+	for _, tc := range []struct {
+		name    string
+		policy  Policy
+		ref     string
+		op      PolicyOperation
+		allowed bool
+	}{
+		{"empty policy", Policy{}, otherRef, PolicyOperationPull, true},
+		{"allowed", Policy{Allow: []PolicyRule{prod}}, tagRef, PolicyOperationPull, true},
+		{"not allowed", Policy{Allow: []PolicyRule{prod}}, otherRef, PolicyOperationPull, false},
+		{"partition", Policy{Allow: []PolicyRule{{Partition: "aws-cn"}}}, tagRef, PolicyOperationPull, false},
+		{"denied", Policy{Allow: []PolicyRule{prod}, Deny: []PolicyRule{{RepositoryPrefix: "prod/app"}}}, tagRef, PolicyOperationPull, false},
+		{"deny push only, pull", Policy{Deny: []PolicyRule{{Operations: []PolicyOperation{PolicyOperationPush}}}}, tagRef, PolicyOperationPull, true},
+		{"deny push only, push", Policy{Deny: []PolicyRule{{Operations: []PolicyOperation{PolicyOperationPush}}}}, tagRef, PolicyOperationPush, false},
+		{"require digest, tag", Policy{RequireDigest: true}, tagRef, PolicyOperationPull, false},
+		{"require digest, digest", Policy{RequireDigest: true}, digestRef, PolicyOperationPull, true},
+		{"require digest, push", Policy{RequireDigest: true}, tagRef, PolicyOperationPush, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			err = tc.policy.check(spec, tc.op)
+			if tc.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			policyErr, ok := err.(*PolicyError)
+			require.True(t, ok, "expected a *PolicyError, got %T", err)
+			assert.Equal(t, spec.Canonical(), policyErr.Ref)
+			assert.Equal(t, tc.op, policyErr.Operation)
+		})
+	}
+}
+
+func TestPolicyErrorClass(t *testing.T) {
+	err := errors.Wrap(&PolicyError{Ref: "ref", Operation: PolicyOperationPull, Reason: "reason"}, "wrapped")
+	assert.True(t, IsPolicyDenied(err))
+	assert.Equal(t, ecrerr.ErrAccessDenied, errors.Cause(err))
+	assert.False(t, IsPolicyDenied(errors.Wrap(ecrerr.ErrAccessDenied, "wrapped")))
+	assert.False(t, IsPolicyDenied(nil))
+}
+
+func TestResolverPolicy(t *testing.T) {
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			// the API is not called, so the nil functions do not panic
+			"fake": &fakeECRClient{},
+		},
+		policy: &Policy{Deny: []PolicyRule{{RepositoryPrefix: "foo/"}}},
+	}
+	ctx := context.Background()
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	_, _, err := resolver.Resolve(ctx, ref)
+	assert.True(t, IsPolicyDenied(err), "Resolve should be denied: %v", err)
+	_, err = resolver.Fetcher(ctx, ref)
+	assert.True(t, IsPolicyDenied(err), "Fetcher should be denied: %v", err)
+	_, err = resolver.Pusher(ctx, ref)
+	assert.True(t, IsPolicyDenied(err), "Pusher should be denied: %v", err)
+	_, err = resolver.Referrers(ctx, ref, digest.FromString("subject"), "")
+	assert.True(t, IsPolicyDenied(err), "Referrers should be denied: %v", err)
+}
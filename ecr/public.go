@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// publicRegistryHost is the hostname of the Amazon ECR Public registry.
+	publicRegistryHost = "public.ecr.aws"
+	// publicService is the ARN service of Amazon ECR Public.
+	publicService = "ecr-public"
+	// publicRegion is the region of the Amazon ECR Public API.
+	publicRegion = "us-east-1"
+)
+
+// parsePublicImageURI parses an Amazon ECR Public image URI of the form
+// "public.ecr.aws/<alias>/<name>:<tag>".  The account of a public registry
+// cannot be derived from its alias, so the spec has no Registry.
+func parsePublicImageURI(input string) (ECRSpec, error) {
+	fullRepoPath, object := splitResource(strings.TrimPrefix(input, publicRegistryHost+"/"))
+	if sections := strings.SplitN(fullRepoPath, "/", 2); len(sections) != 2 || sections[0] == "" || sections[1] == "" {
+		return ECRSpec{}, errors.New(invalidImageURI)
+	}
+	return ECRSpec{
+		Repository: fullRepoPath,
+		Object:     object,
+		arn: arn.ARN{
+			Partition: "aws",
+			Service:   publicService,
+			Region:    publicRegion,
+			Resource:  "repository/" + fullRepoPath,
+		},
+	}, nil
+}
+
+// Public reports whether the reference is to Amazon ECR Public, such as
+// "public.ecr.aws/<alias>/<name>:<tag>".  The Repository of a public
+// reference includes the registry alias.
+func (spec ECRSpec) Public() bool {
+	return spec.arn.Service == publicService
+}
+
+// getPublicResolver returns the resolver used for Amazon ECR Public.  Amazon
+// ECR Public serves images anonymously through the registry API, so images
+// are resolved and fetched with the containerd Docker resolver rather than
+// the Amazon ECR API.  The Amazon ECR Public API is not used: aws-sdk-go
+// v1.28.9 predates its client, and it has no equivalent of
+// GetDownloadUrlForLayer, so layers would still come from the registry API.
+// As a result, the options that configure downloads through the Amazon ECR
+// API do not apply; see checkPublicOptions.
+func (r *ecrResolver) getPublicResolver() remotes.Resolver {
+	r.clientsLock.Lock()
+	defer r.clientsLock.Unlock()
+	if r.publicResolver == nil {
+		r.publicResolver = docker.NewResolver(docker.ResolverOptions{
+			Client: r.httpClient,
+		})
+	}
+	return r.publicResolver
+}
+
+// checkPublicOptions returns an error if the resolver has options that cannot
+// be applied to Amazon ECR Public images, rather than ignoring them.
+func (r *ecrResolver) checkPublicOptions() error {
+	switch {
+	case r.retryPolicy.MaxAttempts > 1:
+		return errPublicUnsupported("WithRetryPolicy")
+	case r.layerDownloadParallelism > 0:
+		return errPublicUnsupported("WithLayerDownloadParallelism")
+	case r.layerDownloadChunkSize > 0:
+		return errPublicUnsupported("WithLayerDownloadChunkSize")
+	case r.layerDownloadMemoryLimit > 0:
+		return errPublicUnsupported("WithLayerDownloadMemoryLimit")
+	}
+	return nil
+}
+
+// publicFetcher fetches content from Amazon ECR Public, verifying it against
+// the size and digest of its descriptor as the fetcher for private images
+// does.
+type publicFetcher struct {
+	remotes.Fetcher
+}
+
+func (f publicFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := f.Fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return newVerifyingReader(rc, desc)
+}
+
+// fetcherPublic returns a fetcher for a reference to Amazon ECR Public.
+func (r *ecrResolver) fetcherPublic(ctx context.Context, ecrSpec ECRSpec) (remotes.Fetcher, error) {
+	if err := r.checkPublicOptions(); err != nil {
+		return nil, err
+	}
+	fetcher, err := r.getPublicResolver().Fetcher(ctx, ecrSpec.ImageURI())
+	if err != nil {
+		return nil, err
+	}
+	return publicFetcher{fetcher}, nil
+}
+
+// resolvePublic resolves a reference to Amazon ECR Public, verifying the
+// image if the resolver has a verifier.
+func (r *ecrResolver) resolvePublic(ctx context.Context, ref string, ecrSpec ECRSpec) (string, ocispec.Descriptor, error) {
+	if err := r.checkPublicOptions(); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	resolver := r.getPublicResolver()
+	_, desc, err := resolver.Resolve(ctx, ecrSpec.ImageURI())
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	log.G(ctx).
+		WithField("ref", ref).
+		WithField("desc", desc).
+		Debug("ecr.resolver.resolve: resolved public image")
+
+	if r.verifier != nil {
+		manifest, err := fetchPublicManifest(ctx, resolver, ecrSpec, desc)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+		if err := r.verifier.Verify(ctx, ecrSpec, desc, manifest); err != nil {
+			log.G(ctx).
+				WithField("ref", ref).
+				WithField("digest", desc.Digest).
+				WithError(err).
+				Warn("ecr.resolver.resolve: image failed verification")
+			return "", ocispec.Descriptor{}, err
+		}
+	}
+	return ecrSpec.name(ref), desc, nil
+}
+
+// fetchPublicManifest fetches the manifest described by desc so that it can
+// be verified.
+func fetchPublicManifest(ctx context.Context, resolver remotes.Resolver, ecrSpec ECRSpec, desc ocispec.Descriptor) ([]byte, error) {
+	fetcher, err := resolver.Fetcher(ctx, ecrSpec.ImageURI())
+	if err != nil {
+		return nil, err
+	}
+	rc, err := publicFetcher{fetcher}.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, desc.Size))
+}
+
+// errPublicUnsupported returns an error for an operation that is not
+// supported for Amazon ECR Public.
+func errPublicUnsupported(op string) error {
+	return errors.Wrapf(errdefs.ErrNotImplemented, "ecr: %s is not supported for Amazon ECR Public", op)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePublicImageURI(t *testing.T) {
+	for _, tc := range []struct {
+		uri        string
+		repository string
+		object     string
+	}{
+		{"public.ecr.aws/alias/repo", "alias/repo", ""},
+		{"public.ecr.aws/alias/foo/bar:latest", "alias/foo/bar", "latest"},
+		{"public.ecr.aws/alias/repo@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "alias/repo", "@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			spec, err := ParseRef(tc.uri)
+			require.NoError(t, err)
+			assert.True(t, spec.Public())
+			assert.Equal(t, tc.repository, spec.Repository)
+			assert.Equal(t, tc.object, spec.Object)
+			assert.Equal(t, tc.uri, spec.ImageURI())
+			assert.Equal(t, tc.uri, spec.Canonical())
+		})
+	}
+
+	for _, uri := range []string{
+		"public.ecr.aws/",
+		"public.ecr.aws/repo:latest",
+		"public.ecr.aws//repo:latest",
+	} {
+		t.Run("invalid-"+uri, func(t *testing.T) {
+			_, err := ParseImageURI(uri)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// fakePublicResolver is a fakeResolver that fetches the same content for
+// every descriptor.
+type fakePublicResolver struct {
+	fakeResolver
+	content []byte
+}
+
+func (r *fakePublicResolver) Fetcher(context.Context, string) (remotes.Fetcher, error) {
+	return r, nil
+}
+
+func (r *fakePublicResolver) Fetch(context.Context, ocispec.Descriptor) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(r.content)), nil
+}
+
+func TestResolvePublic(t *testing.T) {
+	const ref = "public.ecr.aws/alias/repo:latest"
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`)
+	public := &fakePublicResolver{
+		fakeResolver: fakeResolver{digest: digest.FromBytes(manifest), size: int64(len(manifest))},
+		content:      manifest,
+	}
+	verified := false
+	resolver := &ecrResolver{
+		// the Amazon ECR API is not used for public images
+		clients:        map[string]ECRClient{},
+		publicResolver: public,
+		verifier: VerifierFunc(func(_ context.Context, spec ECRSpec, desc ocispec.Descriptor, m []byte) error {
+			verified = true
+			assert.True(t, spec.Public())
+			assert.Equal(t, manifest, m)
+			return nil
+		}),
+	}
+	ctx := context.Background()
+
+	name, desc, err := resolver.Resolve(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref, name)
+	assert.Equal(t, digest.FromBytes(manifest), desc.Digest)
+	assert.Equal(t, []string{ref}, public.refs)
+	assert.True(t, verified, "public images should be verified")
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	require.NoError(t, err)
+	rc, err := fetcher.Fetch(ctx, desc)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, manifest, b)
+
+	// public content is verified against its digest
+	public.content = []byte("tampered")
+	rc, err = fetcher.Fetch(ctx, desc)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(rc)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "tampered content should fail verification: %v", err)
+
+	_, err = resolver.Pusher(ctx, ref)
+	assert.True(t, errdefs.IsNotImplemented(err), "push should not be implemented: %v", err)
+	_, err = resolver.Referrers(ctx, ref, digest.FromBytes(manifest), "")
+	assert.True(t, errdefs.IsNotImplemented(err), "referrers should not be implemented: %v", err)
+}
+
+func TestPublicOptionsUnsupported(t *testing.T) {
+	const ref = "public.ecr.aws/alias/repo:latest"
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		option ResolverOption
+	}{
+		{"retry policy", WithRetryPolicy(RetryPolicy{MaxAttempts: 3})},
+		{"download parallelism", WithLayerDownloadParallelism(4)},
+		{"download chunk size", WithLayerDownloadChunkSize(1 << 20)},
+		{"download memory limit", WithLayerDownloadMemoryLimit(1 << 30)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver, err := NewResolver(WithClientFactory(func(string, string) ECRClient { return &fakeECRClient{} }), tc.option)
+			require.NoError(t, err)
+			resolver.(*ecrResolver).publicResolver = &fakePublicResolver{}
+
+			_, _, err = resolver.Resolve(ctx, ref)
+			assert.True(t, errdefs.IsNotImplemented(err), "Resolve should fail: %v", err)
+			_, err = resolver.Fetcher(ctx, ref)
+			assert.True(t, errdefs.IsNotImplemented(err), "Fetcher should fail: %v", err)
+		})
+	}
+}
@@ -17,10 +17,14 @@ package ecr
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
@@ -28,19 +32,26 @@ import (
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
-var (
-	errLayerNotFound = errors.New("ecr: layer not found")
-)
-
 // ecrPusher implements the containerd remotes.Pusher interface and can be used
 // to push images to Amazon ECR.
 type ecrPusher struct {
 	ecrBase
-	tracker docker.StatusTracker
+	tracker           docker.StatusTracker
+	uploadReadAhead   int
+	uploadMemoryLimit int64
+	retryPolicy       RetryPolicy
+	uploadStore       UploadStore
+	// pushNonDistributable uploads non-distributable layers instead of
+	// skipping them.
+	pushNonDistributable bool
+	// childManifests holds the manifests referenced from the indexes being
+	// pushed, as recorded by PushHandler.
+	childManifests *childManifests
 }
 
 var _ remotes.Pusher = (*ecrPusher)(nil)
@@ -52,14 +63,35 @@ func (p ecrPusher) Push(ctx context.Context, desc ocispec.Descriptor) (content.W
 	switch desc.MediaType {
 	case
 		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
 		images.MediaTypeDockerSchema2Manifest,
-		images.MediaTypeDockerSchema1Manifest:
+		images.MediaTypeDockerSchema2ManifestList,
+		images.MediaTypeDockerSchema1Manifest,
+		mediaTypeArtifactManifest:
 		return p.pushManifest(ctx, desc)
 	default:
+		if isNonDistributable(desc.MediaType) && !p.pushNonDistributable {
+			// Like the Docker pusher, leave non-distributable layers to be
+			// fetched from their own URLs.  Reporting them as existing lets
+			// the rest of the image be pushed.
+			log.G(ctx).Debug("ecr.pusher.blob: skipping non-distributable layer")
+			p.markStatusExists(ctx, desc)
+			return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "non-distributable content %v skipped", desc.Digest)
+		}
 		return p.pushBlob(ctx, desc)
 	}
+}
 
-	return nil, unimplemented
+// isNonDistributable reports whether mediaType is a foreign or
+// non-distributable layer, which may be subject to license terms that
+// restrict where it can be uploaded.
+func isNonDistributable(mediaType string) bool {
+	switch mediaType {
+	case images.MediaTypeDockerSchema2LayerForeign,
+		images.MediaTypeDockerSchema2LayerForeignGzip:
+		return true
+	}
+	return strings.HasPrefix(mediaType, "application/vnd.oci.image.layer.nondistributable.")
 }
 
 func (p ecrPusher) pushManifest(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
@@ -73,23 +105,33 @@ func (p ecrPusher) pushManifest(ctx context.Context, desc ocispec.Descriptor) (c
 	if exists {
 		log.G(ctx).Debug("ecr.pusher.manifest: content already on remote")
 		p.markStatusExists(ctx, desc)
+		// the index is not committed, so release its children here
+		p.childManifests.releaseIndex(p.ecrSpec.ARN(), desc.Digest)
 		return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "content %v on remote", desc.Digest)
 	}
 
 	ref := p.markStatusStarted(ctx, desc)
 	return &manifestWriter{
-		ctx:     ctx,
-		base:    &p.ecrBase,
-		desc:    desc,
-		tracker: p.tracker,
-		ref:     ref,
+		ctx:            ctx,
+		base:           &p.ecrBase,
+		desc:           desc,
+		tracker:        p.tracker,
+		ref:            ref,
+		child:          p.childManifests.contains(p.ecrSpec.ARN(), desc.Digest),
+		childManifests: p.childManifests,
 	}, nil
 }
 
 func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
-	image, err := p.getManifest(ctx)
+	// Child manifests are pushed without a tag, so they only need to exist by
+	// digest.  Tagged manifests also need the tag to point at them.
+	imageID := p.ecrSpec.ImageID()
+	if p.childManifests.contains(p.ecrSpec.ARN(), desc.Digest) {
+		imageID = &ecr.ImageIdentifier{ImageDigest: aws.String(desc.Digest.String())}
+	}
+	image, err := p.getImage(ctx, imageID)
 	if err != nil {
-		if err == errImageNotFound {
+		if errdefs.IsNotFound(err) {
 			return false, nil
 		}
 		return false, err
@@ -102,6 +144,134 @@ func (p ecrPusher) checkManifestExistence(ctx context.Context, desc ocispec.Desc
 	return found, nil
 }
 
+// childManifests records the digests of the manifests referenced from the
+// image indexes and manifest lists being pushed.  containerd pushes these
+// children before the index itself, and they must not take the tag from the
+// ref, which belongs to the index.  Descriptors do not say whether they are
+// referenced from an index, so children are recorded by PushHandler while
+// containerd walks the image, before anything is pushed.  Manifests are
+// recorded by repository, so that pushes of the same manifest to other
+// repositories are not affected, and are released once the index referencing
+// them has been pushed or is found to exist already.
+type childManifests struct {
+	mu sync.Mutex
+	// counts holds the number of indexes referencing each child.
+	counts map[childManifestKey]int
+	// indexes holds the children of each index.
+	indexes map[childManifestKey][]digest.Digest
+}
+
+// childManifestKey identifies a manifest in the repository with the given
+// ARN.
+type childManifestKey struct {
+	repository string
+	digest     digest.Digest
+}
+
+func newChildManifests() *childManifests {
+	return &childManifests{
+		counts:  map[childManifestKey]int{},
+		indexes: map[childManifestKey][]digest.Digest{},
+	}
+}
+
+// addIndex records the children of the index being pushed to repository.
+// Recording the same index again has no effect until it is released.
+func (c *childManifests) addIndex(repository string, index digest.Digest, children []digest.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := childManifestKey{repository, index}
+	if _, ok := c.indexes[key]; ok {
+		return
+	}
+	c.indexes[key] = children
+	for _, child := range children {
+		c.counts[childManifestKey{repository, child}]++
+	}
+}
+
+// releaseIndex releases the children recorded by addIndex for the index, once
+// it has been pushed to repository or found to exist already.
+func (c *childManifests) releaseIndex(repository string, index digest.Digest) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := childManifestKey{repository, index}
+	children, ok := c.indexes[key]
+	if !ok {
+		return
+	}
+	delete(c.indexes, key)
+	for _, child := range children {
+		childKey := childManifestKey{repository, child}
+		if c.counts[childKey] <= 1 {
+			delete(c.counts, childKey)
+			continue
+		}
+		c.counts[childKey]--
+	}
+}
+
+// contains reports whether dgst is referenced from an index being pushed to
+// repository.
+func (c *childManifests) contains(repository string, dgst digest.Digest) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[childManifestKey{repository, dgst}] > 0
+}
+
+// PushHandler returns a handler for pushing multi-platform images to ref with
+// resolver, for use with containerd.WithImageHandler.  It reads each image
+// index and manifest list being pushed from provider and records the
+// manifests it references, so that they are pushed untagged and the tag of
+// the ref is only applied to the index.  Without it, every manifest is pushed
+// with the tag, and the tag points at a platform-specific manifest until the
+// index is pushed.  For resolvers not created by NewResolver, the handler does
+// nothing.
+func PushHandler(resolver remotes.Resolver, ref string, provider content.Provider) images.Handler {
+	if locked, ok := resolver.(*lockedResolver); ok {
+		resolver = locked.Resolver
+	}
+	r, ok := resolver.(*ecrResolver)
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if !ok || r.childManifests == nil {
+			return nil, nil
+		}
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		default:
+			return nil, nil
+		}
+		ecrSpec, err := ParseRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		p, err := content.ReadBlob(ctx, provider, desc)
+		if err != nil {
+			return nil, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(p, &index); err != nil {
+			return nil, errors.Wrapf(err, "ecr: failed to parse index %v", desc.Digest)
+		}
+		children := make([]digest.Digest, 0, len(index.Manifests))
+		for _, child := range index.Manifests {
+			children = append(children, child.Digest)
+		}
+		r.childManifests.addIndex(ecrSpec.ARN(), desc.Digest, children)
+		log.G(ctx).
+			WithField("digest", desc.Digest).
+			WithField("children", len(index.Manifests)).
+			Debug("ecr.pusher.index: recorded child manifests")
+		return nil, nil
+	})
+}
+
 func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
 	log.G(ctx).Debug("ecr.pusher.blob")
 	exists, err := p.checkBlobExistence(ctx, desc)
@@ -117,7 +287,7 @@ func (p ecrPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor) (conte
 	}
 
 	ref := p.markStatusStarted(ctx, desc)
-	return newLayerWriter(&p.ecrBase, p.tracker, ref, desc)
+	return newLayerWriter(ctx, &p, ref, desc)
 }
 
 func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
@@ -130,7 +300,7 @@ func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descript
 	batchCheckLayerAvailabilityOutput, err := p.client.BatchCheckLayerAvailabilityWithContext(ctx, batchCheckLayerAvailabilityInput)
 	if err != nil {
 		log.G(ctx).WithError(err).Error("ecr.pusher.blob: failed to check availability")
-		return false, err
+		return false, ecrerr.FromAWSError("BatchCheckLayerAvailability", err)
 	}
 	log.G(ctx).
 		WithField("batchCheckLayerAvailability", batchCheckLayerAvailabilityOutput).
@@ -138,7 +308,13 @@ func (p ecrPusher) checkBlobExistence(ctx context.Context, desc ocispec.Descript
 
 	if len(batchCheckLayerAvailabilityOutput.Layers) == 0 {
 		if len(batchCheckLayerAvailabilityOutput.Failures) > 0 {
-			return false, errLayerNotFound
+			err := ecrerr.FromLayerFailure("BatchCheckLayerAvailability", batchCheckLayerAvailabilityOutput.Failures[0])
+			// Layers that have never been pushed to the repository are
+			// reported as a failure rather than as unavailable.
+			if errdefs.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
 		}
 		return false, reference.ErrInvalid
 	}
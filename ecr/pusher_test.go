@@ -16,7 +16,9 @@
 package ecr
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -24,6 +26,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/remotes"
@@ -58,7 +62,9 @@ func TestPushManifestReturnsManifestWriter(t *testing.T) {
 	// test all supported media types
 	for _, mediaType := range []string{
 		ocispec.MediaTypeImageManifest,
+		ocispec.MediaTypeImageIndex,
 		images.MediaTypeDockerSchema2Manifest,
+		images.MediaTypeDockerSchema2ManifestList,
 		images.MediaTypeDockerSchema1Manifest,
 	} {
 		t.Run(mediaType, func(t *testing.T) {
@@ -72,6 +78,8 @@ func TestPushManifestReturnsManifestWriter(t *testing.T) {
 				assert.Equal(t, []*string{
 					aws.String(ocispec.MediaTypeImageManifest),
 					aws.String(images.MediaTypeDockerSchema2Manifest),
+					aws.String(ocispec.MediaTypeImageIndex),
+					aws.String(images.MediaTypeDockerSchema2ManifestList),
 				}, input.AcceptedMediaTypes)
 				return &ecr.BatchGetImageOutput{
 					Failures: []*ecr.ImageFailure{
@@ -155,12 +163,212 @@ func TestPushManifestAlreadyExists(t *testing.T) {
 		"should be updated between start and end")
 }
 
+func TestPushChildManifestAlreadyExists(t *testing.T) {
+	registry := "registry"
+	repository := "repository"
+	imageTag := "tag"
+	childDigest := "sha256:child"
+	callCount := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			callCount++
+			// child manifests are untagged, so existence is checked by digest
+			assert.Equal(t, []*ecr.ImageIdentifier{{ImageDigest: aws.String(childDigest)}}, input.ImageIds)
+			return &ecr.BatchGetImageOutput{
+				Images: []*ecr.Image{
+					{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(childDigest)}},
+				},
+			}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: registry,
+				},
+				Repository: repository,
+				Object:     imageTag,
+			},
+		},
+		tracker:        docker.NewInMemoryTracker(),
+		childManifests: newChildManifests(),
+	}
+	// children are known from the index, not from their descriptors, which
+	// need not have a platform
+	pusher.childManifests.addIndex(pusher.ecrSpec.ARN(), digest.FromString("index"), []digest.Digest{digest.Digest(childDigest)})
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.Digest(childDigest),
+	}
+
+	_, err := pusher.Push(context.Background(), desc)
+	assert.Error(t, err)
+	assert.Equal(t, errdefs.ErrAlreadyExists, errors.Cause(err))
+	assert.Equal(t, 1, callCount, "BatchGetImage should be called once")
+}
+
+func TestPushPlatformManifestTagged(t *testing.T) {
+	imageTag := "tag"
+	manifestDigest := "sha256:manifest"
+	callCount := 0
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			callCount++
+			// a manifest that is not referenced from an index is tagged, even
+			// if its descriptor has a platform
+			assert.Equal(t, []*ecr.ImageIdentifier{{ImageTag: aws.String(imageTag)}}, input.ImageIds)
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)}},
+			}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: "registry",
+				},
+				Repository: "repository",
+				Object:     imageTag,
+			},
+		},
+		tracker:        docker.NewInMemoryTracker(),
+		childManifests: newChildManifests(),
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.Digest(manifestDigest),
+		Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+	}
+
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	assert.Equal(t, 1, callCount, "BatchGetImage should be called once")
+	mw, ok := writer.(*manifestWriter)
+	require.True(t, ok, "writer should be a manifestWriter")
+	assert.False(t, mw.child, "manifest should be tagged")
+}
+
+// fakeProvider serves content from memory.
+type fakeProvider map[digest.Digest][]byte
+
+func (p fakeProvider) ReaderAt(_ context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	b, ok := p[desc.Digest]
+	if !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	return nopCloserReaderAt{bytes.NewReader(b)}, nil
+}
+
+type nopCloserReaderAt struct {
+	*bytes.Reader
+}
+
+func (nopCloserReaderAt) Close() error { return nil }
+
+const pushHandlerRef = "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:tag"
+
+func TestPushHandler(t *testing.T) {
+	manifest := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("manifest"), Size: 1}
+	body := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":1}]}`,
+		ocispec.MediaTypeImageIndex, manifest.MediaType, manifest.Digest)
+	index := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString(body), Size: int64(len(body))}
+	provider := fakeProvider{index.Digest: []byte(body)}
+	resolver := &ecrResolver{childManifests: newChildManifests()}
+	ctx := context.Background()
+	spec, err := ParseRef(pushHandlerRef)
+	require.NoError(t, err)
+	repository := spec.ARN()
+
+	handler := PushHandler(resolver, pushHandlerRef, provider)
+	for _, desc := range []ocispec.Descriptor{index, manifest} {
+		children, err := handler.Handle(ctx, desc)
+		require.NoError(t, err)
+		assert.Empty(t, children, "children are left to the children handler")
+	}
+	assert.True(t, resolver.childManifests.contains(repository, manifest.Digest), "index children should be recorded")
+	assert.False(t, resolver.childManifests.contains(repository, index.Digest), "the index should not be recorded")
+	other, err := ParseRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/other:tag")
+	require.NoError(t, err)
+	assert.False(t, resolver.childManifests.contains(other.ARN(), manifest.Digest), "other repositories should not be affected")
+
+	// the children are released once the index is pushed
+	mw := &manifestWriter{
+		ctx: ctx,
+		base: &ecrBase{
+			client: &fakeECRClient{
+				PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+					assert.Equal(t, "tag", aws.StringValue(input.ImageTag), "the index should be tagged")
+					return &ecr.PutImageOutput{
+						Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(index.Digest.String())}},
+					}, nil
+				},
+			},
+			ecrSpec: spec,
+		},
+		desc:           index,
+		tracker:        docker.NewInMemoryTracker(),
+		childManifests: resolver.childManifests,
+	}
+	_, err = mw.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, mw.Commit(ctx, index.Size, index.Digest))
+	assert.False(t, resolver.childManifests.contains(repository, manifest.Digest), "children should be released")
+
+	// other resolvers are left alone, without reading the index
+	children, err := PushHandler(&fakeResolver{}, pushHandlerRef, fakeProvider{}).Handle(ctx, index)
+	assert.NoError(t, err)
+	assert.Empty(t, children)
+}
+
+func TestPushIndexAlreadyExists(t *testing.T) {
+	manifest := digest.FromString("manifest")
+	body := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":1}]}`,
+		ocispec.MediaTypeImageIndex, ocispec.MediaTypeImageManifest, manifest)
+	index := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromString(body), Size: int64(len(body))}
+	spec, err := ParseRef(pushHandlerRef)
+	require.NoError(t, err)
+	resolver := &ecrResolver{childManifests: newChildManifests()}
+	ctx := context.Background()
+
+	_, err = PushHandler(resolver, pushHandlerRef, fakeProvider{index.Digest: []byte(body)}).Handle(ctx, index)
+	require.NoError(t, err)
+	require.True(t, resolver.childManifests.contains(spec.ARN(), manifest))
+
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: &fakeECRClient{
+				BatchGetImageFn: func(_ aws.Context, _ *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+					return &ecr.BatchGetImageOutput{
+						Images: []*ecr.Image{
+							{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(index.Digest.String())}},
+						},
+					}, nil
+				},
+			},
+			ecrSpec: spec,
+		},
+		tracker:        docker.NewInMemoryTracker(),
+		childManifests: resolver.childManifests,
+	}
+	_, err = pusher.Push(ctx, index)
+	assert.True(t, errdefs.IsAlreadyExists(err), "the index should already exist: %v", err)
+	// the index is never committed, so its children are released when it
+	// is found to exist, and later pushes of the manifest are tagged
+	assert.False(t, resolver.childManifests.contains(spec.ARN(), manifest), "children should be released")
+}
+
 func TestPushBlobReturnsLayerWriter(t *testing.T) {
 	registry := "registry"
 	repository := "repository"
 	layerDigest := "digest"
 	fakeClient := &fakeECRClient{
-		InitiateLayerUploadFn: func(*ecr.InitiateLayerUploadInput) (*ecr.InitiateLayerUploadOutput, error) {
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
 			// layerWriter calls this during its constructor
 			return &ecr.InitiateLayerUploadOutput{}, nil
 		},
@@ -306,5 +514,106 @@ func TestPushBlobAPIError(t *testing.T) {
 	}
 
 	_, err := pusher.Push(context.Background(), desc)
-	assert.EqualError(t, err, errLayerNotFound.Error())
+	require.Error(t, err)
+	ecrErr, ok := err.(*ecrerr.Error)
+	require.True(t, ok, "error should be an ecrerr.Error")
+	assert.Equal(t, "BatchCheckLayerAvailability", ecrErr.Op)
+	assert.Equal(t, errdefs.ErrUnknown, errors.Cause(err))
+}
+
+func TestPushBlobMissingLayer(t *testing.T) {
+	registry := "registry"
+	repository := "repository"
+	layerDigest := "digest"
+	fakeClient := &fakeECRClient{
+		BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+			return &ecr.BatchCheckLayerAvailabilityOutput{
+				Failures: []*ecr.LayerFailure{{
+					LayerDigest: aws.String(layerDigest),
+					FailureCode: aws.String(ecr.LayerFailureCodeMissingLayerDigest),
+				}},
+			}, nil
+		},
+		InitiateLayerUploadFn: func(_ aws.Context, _ *ecr.InitiateLayerUploadInput, _ ...request.Option) (*ecr.InitiateLayerUploadOutput, error) {
+			return &ecr.InitiateLayerUploadOutput{}, nil
+		},
+	}
+	pusher := &ecrPusher{
+		ecrBase: ecrBase{
+			client: fakeClient,
+			ecrSpec: ECRSpec{
+				arn: arn.ARN{
+					AccountID: registry,
+				},
+				Repository: repository,
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.Digest(layerDigest),
+	}
+
+	// a layer that was never pushed is reported as a failure and should be
+	// uploaded rather than failing the push
+	writer, err := pusher.Push(context.Background(), desc)
+	require.NoError(t, err)
+	_, ok := writer.(*layerWriter)
+	assert.True(t, ok, "writer should be a layerWriter")
+	writer.Close()
+}
+
+func TestPushNonDistributableLayer(t *testing.T) {
+	for _, mediaType := range []string{
+		images.MediaTypeDockerSchema2LayerForeign,
+		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip,
+	} {
+		t.Run(mediaType, func(t *testing.T) {
+			desc := ocispec.Descriptor{
+				MediaType: mediaType,
+				Digest:    digest.FromString("foreign layer"),
+			}
+
+			t.Run("skipped", func(t *testing.T) {
+				pusher := &ecrPusher{
+					ecrBase: ecrBase{
+						// the layer should not be checked or uploaded
+						client: &fakeECRClient{},
+					},
+					tracker: docker.NewInMemoryTracker(),
+				}
+				_, err := pusher.Push(context.Background(), desc)
+				assert.Error(t, err)
+				assert.Equal(t, errdefs.ErrAlreadyExists, errors.Cause(err))
+				_, err = pusher.tracker.GetStatus(remotes.MakeRefKey(context.Background(), desc))
+				assert.NoError(t, err, "should mark the layer as done")
+			})
+			t.Run("pushed", func(t *testing.T) {
+				checked := false
+				pusher := &ecrPusher{
+					ecrBase: ecrBase{
+						client: &fakeECRClient{
+							BatchCheckLayerAvailabilityFn: func(aws.Context, *ecr.BatchCheckLayerAvailabilityInput, ...request.Option) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+								checked = true
+								return &ecr.BatchCheckLayerAvailabilityOutput{
+									Layers: []*ecr.Layer{{
+										LayerAvailability: aws.String(ecr.LayerAvailabilityAvailable),
+									}},
+								}, nil
+							},
+						},
+					},
+					tracker:              docker.NewInMemoryTracker(),
+					pushNonDistributable: true,
+				}
+				_, err := pusher.Push(context.Background(), desc)
+				assert.Equal(t, errdefs.ErrAlreadyExists, errors.Cause(err))
+				assert.True(t, checked, "the layer should go through the blob path")
+			})
+		})
+	}
 }
@@ -40,23 +40,36 @@ var (
 	// Expecting to match ECR image names of the form:
 	// Example 1: 777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest
 	// Example 2: 777777777777.dkr.ecr.cn-north-1.amazonaws.com.cn/my_image:latest
-	// TODO: Support ECR FIPS endpoints, i.e "ecr-fips" in the URL instead of "ecr"
-	ecrRegex = regexp.MustCompile(`(^[a-zA-Z0-9][a-zA-Z0-9-_]*)\.dkr\.ecr\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.amazonaws\.com(\.cn)?.*`)
+	// Example 3: 777777777777.dkr.ecr-fips.us-gov-west-1.amazonaws.com/my_image:latest
+	// Example 4: 777777777777.dkr-ecr.us-west-2.on.aws/my_image:latest
+	// Example 5: 777777777777.vpce-0123456789abcdef0.dkr.ecr.us-west-2.vpce.amazonaws.com/my_image:latest
+	// The DNS suffix is checked against the partition of the region.
+	ecrRegex = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9-_]*)\.(?:(vpce-[a-z0-9-]+)\.)?(dkr\.ecr|dkr\.ecr-fips|dkr-ecr|dkr-ecr-fips)\.([a-zA-Z0-9][a-zA-Z0-9-_]*)\.([a-zA-Z0-9.-]+)/(.+)$`)
 )
 
 // ECRSpec represents a parsed reference.
 //
-// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>"
+// or "<account>.dkr.ecr.<region>.amazonaws.com/<name>:<tag>".  Image URIs
+// may also name FIPS, dual-stack, and interface VPC endpoints; the ARN form
+// always uses the standard endpoints.
 type ECRSpec struct {
 	Repository string
 	Object     string
 	arn        arn.ARN
+	endpoint   ecrEndpoint
 }
 
-// ParseRef parses an ECR reference into its constituent parts
+// ParseRef parses an ECR reference into its constituent parts.  Both the
+// "ecr.aws/arn:..." form and the Docker-style image URI form accepted by
+// ParseImageURI are supported.
 func ParseRef(ref string) (ECRSpec, error) {
 	if !strings.HasPrefix(ref, refPrefix) {
-		return ECRSpec{}, invalidARN
+		spec, err := ParseImageURI(ref)
+		if err != nil {
+			return ECRSpec{}, errors.Wrapf(err, "ref: %q is neither an %sarn:... reference nor an image URI", ref, refPrefix)
+		}
+		return spec, nil
 	}
 	stripped := ref[len(refPrefix):]
 	return parseARN(stripped)
@@ -65,24 +78,54 @@ func ParseRef(ref string) (ECRSpec, error) {
 // ParseImageURI takes an ECR image URI and then constructs and returns an ECRSpec struct
 func ParseImageURI(input string) (ECRSpec, error) {
 	input = strings.TrimPrefix(input, "https://")
+	if strings.HasPrefix(input, publicRegistryHost+"/") {
+		return parsePublicImageURI(input)
+	}
 
-	// Matching on account, region
+	// Matching on account, VPC endpoint, service, region, DNS suffix, and
+	// repository path
 	matches := ecrRegex.FindStringSubmatch(input)
-	if len(matches) < 3 {
+	if len(matches) < 7 {
 		return ECRSpec{}, errors.New(invalidImageURI)
 	}
-	region := matches[2]
 	account := matches[1]
+	service := matches[3]
+	region := matches[4]
+	dnsSuffix := matches[5]
+	endpoint := ecrEndpoint{
+		fips:        strings.HasSuffix(service, "-fips"),
+		dualStack:   strings.HasPrefix(service, "dkr-ecr"),
+		vpcEndpoint: matches[2],
+	}
 
 	// Get the correct partition given its region
 	partition, found := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
 	if !found {
 		return ECRSpec{}, errors.New(invalidImageURI)
 	}
+	expectedSuffix := partition.DNSSuffix()
+	switch {
+	case endpoint.vpcEndpoint != "":
+		if service != "dkr.ecr" {
+			return ECRSpec{}, errors.New(invalidImageURI)
+		}
+		expectedSuffix = "vpce." + expectedSuffix
+	case endpoint.dualStack:
+		suffixes, ok := dualStackDNSSuffixes[partition.ID()]
+		if !ok {
+			return ECRSpec{}, errors.New(invalidImageURI)
+		}
+		expectedSuffix = suffixes.registry
+	}
+	if dnsSuffix != expectedSuffix {
+		return ECRSpec{}, errors.New(invalidImageURI)
+	}
 
 	// Need to include the full repository path and the imageID (e.g. /eks/image-name:tag)
-	tokens := strings.SplitN(input, "/", 2)
-	fullRepoPath := tokens[len(tokens)-1]
+	fullRepoPath, object := splitResource(matches[6])
+	if fullRepoPath == "" {
+		return ECRSpec{}, errors.New(invalidImageURI)
+	}
 
 	// Build the ECR ARN
 	ecrARN := arn.ARN{
@@ -92,13 +135,12 @@ func ParseImageURI(input string) (ECRSpec, error) {
 		AccountID: account,
 		Resource:  "repository/" + fullRepoPath,
 	}
-	var object string
-	ecrARN.Resource, object = splitResource(ecrARN.Resource)
 
 	return ECRSpec{
 		Repository: fullRepoPath,
 		Object:     object,
 		arn:        ecrARN,
+		endpoint:   endpoint,
 	}, nil
 }
 
@@ -160,8 +202,19 @@ func splitResource(resource string) (string, string) {
 	return resource, object
 }
 
-// Canonical returns the canonical representation for the reference
+// Canonical returns the canonical representation for the reference.  For
+// Amazon ECR Public, it is the image URI.
 func (spec ECRSpec) Canonical() string {
+	if spec.Public() {
+		// the ARN of a public repository cannot be derived from its alias
+		return spec.ImageURI()
+	}
+	return refPrefix + spec.ARN() + spec.objectSuffix()
+}
+
+// objectSuffix returns the tag and/or digest of the reference as they are
+// appended to a repository, such as ":latest" or "@sha256:...".
+func (spec ECRSpec) objectSuffix() string {
 	object := ""
 	if len(spec.Object) != 0 {
 		if spec.Object[0] != '@' {
@@ -169,7 +222,23 @@ func (spec ECRSpec) Canonical() string {
 		}
 		object = object + spec.Object
 	}
-	return refPrefix + spec.ARN() + object
+	return object
+}
+
+// ImageURI returns the Docker-style image URI for the reference, such as
+// "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar:latest".  ParseRef
+// and ParseImageURI parse the URI back into the same ECRSpec.
+func (spec ECRSpec) ImageURI() string {
+	return spec.registryHost() + "/" + spec.Repository + spec.objectSuffix()
+}
+
+// name returns the reference in the same form as ref, so that names returned
+// by the resolver keep the form that the caller used.
+func (spec ECRSpec) name(ref string) string {
+	if strings.HasPrefix(ref, refPrefix) {
+		return spec.Canonical()
+	}
+	return spec.ImageURI()
 }
 
 // ARN returns the canonical representation of the ECR ARN
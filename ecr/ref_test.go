@@ -35,7 +35,7 @@ func TestRefRepresentations(t *testing.T) {
 	}{
 		{
 			ref: "invalid",
-			err: invalidARN,
+			err: errors.New(`ref: "invalid" is neither an ecr.aws/arn:... reference nor an image URI: ecrspec: Invalid image URI`),
 		},
 		{
 			ref: "ecr.aws/arn:nope",
@@ -43,7 +43,7 @@ func TestRefRepresentations(t *testing.T) {
 		},
 		{
 			ref: "arn:aws:ecr:us-west-2:123456789012:repository/foo/bar",
-			err: invalidARN,
+			err: errors.New(`ref: "arn:aws:ecr:us-west-2:123456789012:repository/foo/bar" is neither an ecr.aws/arn:... reference nor an image URI: ecrspec: Invalid image URI`),
 		},
 		{
 			ref: "ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar",
@@ -112,7 +112,7 @@ func TestRefRepresentations(t *testing.T) {
 			if tc.err == nil {
 				assert.Nil(t, err)
 			} else {
-				assert.Equal(t, tc.err, err)
+				assert.EqualError(t, err, tc.err.Error())
 			}
 		})
 		if tc.err != nil {
@@ -249,6 +249,18 @@ func TestParseImageURIInvalid(t *testing.T) {
 			"not an ecr image",
 			"docker.io/library/hello-world",
 		},
+		{
+			"no repository",
+			"777777777777.dkr.ecr.us-west-2.amazonaws.com/",
+		},
+		{
+			"wrong partition suffix",
+			"777777777777.dkr.ecr.cn-north-1.amazonaws.com/my_image:latest",
+		},
+		{
+			"other host",
+			"777777777777.dkr.ecr.us-west-2.amazonaws.com.example.com/my_image:latest",
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -257,3 +269,91 @@ func TestParseImageURIInvalid(t *testing.T) {
 		})
 	}
 }
+
+func TestImageURIRoundTrip(t *testing.T) {
+	for _, uri := range []string{
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image",
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/foo/bar/my_image:latest",
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"777777777777.dkr.ecr.cn-north-1.amazonaws.com.cn/my_image:latest",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			spec, err := ParseRef(uri)
+			assert.NoError(t, err)
+			assert.Equal(t, uri, spec.ImageURI())
+
+			// the ARN form parses to the same spec
+			fromARN, err := ParseRef(spec.Canonical())
+			assert.NoError(t, err)
+			assert.Equal(t, spec, fromARN)
+			assert.Equal(t, uri, fromARN.ImageURI())
+		})
+	}
+}
+
+func TestImageURIEndpoints(t *testing.T) {
+	cases := []struct {
+		uri         string
+		fips        bool
+		dualStack   bool
+		vpcEndpoint string
+		apiEndpoint string
+	}{
+		{
+			uri: "777777777777.dkr.ecr.us-west-2.amazonaws.com/my_image:latest",
+		},
+		{
+			uri:         "777777777777.dkr.ecr-fips.us-gov-west-1.amazonaws.com/my_image:latest",
+			fips:        true,
+			apiEndpoint: "https://ecr-fips.us-gov-west-1.amazonaws.com",
+		},
+		{
+			uri:         "777777777777.dkr-ecr.us-west-2.on.aws/my_image:latest",
+			dualStack:   true,
+			apiEndpoint: "https://ecr.us-west-2.api.aws",
+		},
+		{
+			uri:         "777777777777.dkr-ecr-fips.us-east-1.on.aws/my_image:latest",
+			fips:        true,
+			dualStack:   true,
+			apiEndpoint: "https://ecr-fips.us-east-1.api.aws",
+		},
+		{
+			uri:         "777777777777.dkr-ecr.cn-north-1.on.amazonwebservices.com.cn/my_image:latest",
+			dualStack:   true,
+			apiEndpoint: "https://ecr.cn-north-1.api.amazonwebservices.com.cn",
+		},
+		{
+			uri:         "777777777777.vpce-0123456789abcdef0.dkr.ecr.us-west-2.vpce.amazonaws.com/my_image:latest",
+			vpcEndpoint: "vpce-0123456789abcdef0",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.uri, func(t *testing.T) {
+			spec, err := ParseRef(tc.uri)
+			assert.NoError(t, err)
+			assert.Equal(t, "777777777777", spec.Registry())
+			assert.Equal(t, "my_image", spec.Repository)
+			assert.Equal(t, "latest", spec.Object)
+			assert.Equal(t, tc.fips, spec.FIPS())
+			assert.Equal(t, tc.dualStack, spec.DualStack())
+			assert.Equal(t, tc.vpcEndpoint, spec.VPCEndpoint())
+			assert.Equal(t, tc.apiEndpoint, spec.apiEndpoint())
+			assert.Equal(t, tc.uri, spec.ImageURI())
+		})
+	}
+
+	for _, uri := range []string{
+		"777777777777.dkr-ecr.us-west-2.amazonaws.com/my_image:latest",
+		"777777777777.dkr.ecr-fips.us-west-2.on.aws/my_image:latest",
+		"777777777777.dkr-ecr.us-iso-east-1.on.aws/my_image:latest",
+		"777777777777.vpce-0123456789abcdef0.dkr.ecr.us-west-2.amazonaws.com/my_image:latest",
+		"777777777777.vpce-0123456789abcdef0.dkr-ecr.us-west-2.vpce.amazonaws.com/my_image:latest",
+	} {
+		t.Run("invalid-"+uri, func(t *testing.T) {
+			_, err := ParseImageURI(uri)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,407 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr/ecrerr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// mediaTypeArtifactManifest is the media type of OCI artifact manifests.
+const mediaTypeArtifactManifest = "application/vnd.oci.artifact.manifest.v1+json"
+
+// batchGetImageLimit is the maximum number of images that can be requested
+// in a single call to BatchGetImage.
+const batchGetImageLimit = 100
+
+// describeImagesLimit is the maximum number of images that can be listed in a
+// single call to DescribeImages.
+const describeImagesLimit = 1000
+
+// cosignTagSuffixes are the suffixes of the tags that cosign gives to the
+// signatures, attestations, and SBOMs of a manifest.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// Referrer describes a manifest that refers to a subject manifest, such as a
+// signature, an SBOM, or an attestation.
+type Referrer struct {
+	ocispec.Descriptor
+	// ArtifactType is the type of the artifact.  It is the artifactType of
+	// the manifest, or the media type of its config if the manifest has no
+	// artifactType.
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// ReferrersLister lists the manifests that refer to a subject manifest.  The
+// remotes.Resolver returned by NewResolver implements ReferrersLister.
+type ReferrersLister interface {
+	// Referrers returns the manifests in the repository of ref that refer
+	// to the manifest with the subject digest.  If artifactType is not
+	// empty, only referrers with that artifact type are returned.
+	Referrers(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error)
+}
+
+var _ ReferrersLister = (*ecrResolver)(nil)
+
+// Referrers returns the manifests in the repository of ref that refer to the
+// manifest with the subject digest.  Amazon ECR does not provide the OCI
+// referrers API, so referrers are found in three ways:
+//
+// - in the image index tagged with the referrers tag schema, "<alg>-<hex>",
+// which is maintained when manifests with a subject are pushed
+//
+// - in manifests tagged by cosign as "<alg>-<hex>.sig", ".att", or ".sbom"
+//
+// - by scanning the untagged manifests of the repository for a subject field,
+// which finds referrers pushed by clients that do not maintain the index
+//
+// The cost of the scan grows with the number of untagged images in the
+// repository, so the scan only runs when neither the index nor the cosign tags
+// list any referrers of the subject.
+func (r *ecrResolver) Referrers(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	base, err := r.referrersBase(ctx, ref, subject)
+	if err != nil {
+		return nil, err
+	}
+	return base.referrers(ctx, subject, artifactType)
+}
+
+// boundedReferrersLister is implemented by listers that can look for
+// referrers in the referrers index and the cosign tags alone, and scan a
+// limited number of untagged images separately, so that the cost of each
+// lookup is bounded.
+type boundedReferrersLister interface {
+	taggedReferrers(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error)
+	scannedReferrers(ctx context.Context, ref string, subject digest.Digest, artifactType string, limit int) ([]Referrer, error)
+}
+
+var _ boundedReferrersLister = (*ecrResolver)(nil)
+
+// taggedReferrers returns the referrers listed in the referrers index and the
+// cosign tags, without scanning the untagged images of the repository.
+func (r *ecrResolver) taggedReferrers(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	base, err := r.referrersBase(ctx, ref, subject)
+	if err != nil {
+		return nil, err
+	}
+	referrers, _, err := base.taggedReferrers(ctx, subject, artifactType)
+	return referrers, err
+}
+
+// scannedReferrers returns the referrers found by scanning at most limit
+// untagged images of the repository.
+func (r *ecrResolver) scannedReferrers(ctx context.Context, ref string, subject digest.Digest, artifactType string, limit int) ([]Referrer, error) {
+	base, err := r.referrersBase(ctx, ref, subject)
+	if err != nil {
+		return nil, err
+	}
+	return base.scannedReferrers(ctx, subject, artifactType, limit)
+}
+
+// referrersBase returns the ecrBase for listing the referrers of subject in
+// the repository of ref.
+func (r *ecrResolver) referrersBase(ctx context.Context, ref string, subject digest.Digest) (*ecrBase, error) {
+	log.G(ctx).WithField("ref", ref).WithField("subject", subject).Debug("ecr.resolver.referrers")
+	ecrSpec, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkPolicy(ctx, ecrSpec, PolicyOperationPull); err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return nil, errPublicUnsupported("listing referrers")
+	}
+	if err := subject.Validate(); err != nil {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.referrers: invalid subject digest %q: %v", subject, err)
+	}
+	return &ecrBase{
+		client:  r.getClient(ecrSpec),
+		ecrSpec: ecrSpec,
+	}, nil
+}
+
+// referrersTag returns the tag of the image index listing the referrers of
+// subject, following the referrers tag schema of the OCI distribution
+// specification.
+func referrersTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Hex()
+}
+
+// referrerManifest holds the fields of a manifest or index that are needed to
+// describe it as a referrer, or to read the referrers listed in an index.
+type referrerManifest struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType,omitempty"`
+	ArtifactType  string              `json:"artifactType,omitempty"`
+	Config        *ocispec.Descriptor `json:"config,omitempty"`
+	Subject       *ocispec.Descriptor `json:"subject,omitempty"`
+	Manifests     []Referrer          `json:"manifests,omitempty"`
+	Annotations   map[string]string   `json:"annotations,omitempty"`
+}
+
+// parseReferrerManifest parses body, filling in the media type from the shape
+// of the document if it is not set.
+func parseReferrerManifest(ctx context.Context, body string) (referrerManifest, error) {
+	var manifest referrerManifest
+	if err := json.Unmarshal([]byte(body), &manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = parseImageManifestMediaType(ctx, body)
+	}
+	return manifest, nil
+}
+
+// referrer describes the manifest body as a referrer.
+func (m referrerManifest) referrer(body string) Referrer {
+	artifactType := m.ArtifactType
+	if artifactType == "" && m.Config != nil {
+		artifactType = m.Config.MediaType
+	}
+	return Referrer{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   m.MediaType,
+			Digest:      digest.FromString(body),
+			Size:        int64(len(body)),
+			Annotations: m.Annotations,
+		},
+		ArtifactType: artifactType,
+	}
+}
+
+// referrers returns the referrers of subject with artifactType, or of any
+// type if artifactType is empty.  If the referrers index and the cosign tags
+// list no referrers of any type, the untagged manifests of the repository are
+// scanned as well.
+func (b *ecrBase) referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	referrers, found, err := b.taggedReferrers(ctx, subject, artifactType)
+	if err != nil || found {
+		return referrers, err
+	}
+	return b.scannedReferrers(ctx, subject, artifactType, 0)
+}
+
+// referrerFilter collects the referrers with artifactType, or of any type if
+// artifactType is empty, skipping duplicates.
+type referrerFilter struct {
+	artifactType string
+	referrers    []Referrer
+	seen         map[digest.Digest]bool
+	// found is set once a referrer of any type has been added.
+	found bool
+}
+
+func (f *referrerFilter) add(referrer Referrer) {
+	f.found = true
+	if f.seen[referrer.Digest] || (f.artifactType != "" && referrer.ArtifactType != f.artifactType) {
+		return
+	}
+	if f.seen == nil {
+		f.seen = map[digest.Digest]bool{}
+	}
+	f.seen[referrer.Digest] = true
+	f.referrers = append(f.referrers, referrer)
+}
+
+// taggedReferrers returns the referrers of subject with artifactType listed
+// in the referrers index and the cosign tags, and whether they list any
+// referrers of any type.
+func (b *ecrBase) taggedReferrers(ctx context.Context, subject digest.Digest, artifactType string) ([]Referrer, bool, error) {
+	filter := referrerFilter{artifactType: artifactType}
+
+	// the referrers index and the cosign tags
+	tag := referrersTag(subject)
+	ids := []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}}
+	for _, suffix := range cosignTagSuffixes {
+		ids = append(ids, &ecr.ImageIdentifier{ImageTag: aws.String(tag + suffix)})
+	}
+	images, err := b.batchGetImages(ctx, ids)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, image := range images {
+		body := aws.StringValue(image.ImageManifest)
+		manifest, err := parseReferrerManifest(ctx, body)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("ecr.referrers: could not parse manifest")
+			continue
+		}
+		if aws.StringValue(image.ImageId.ImageTag) == tag {
+			for _, referrer := range manifest.Manifests {
+				filter.add(referrer)
+			}
+			continue
+		}
+		filter.add(manifest.referrer(body))
+	}
+	return filter.referrers, filter.found, nil
+}
+
+// scannedReferrers returns the referrers of subject with artifactType found by
+// scanning the untagged manifests of the repository for a subject field.  If
+// limit is positive, at most limit untagged manifests are scanned.
+func (b *ecrBase) scannedReferrers(ctx context.Context, subject digest.Digest, artifactType string, limit int) ([]Referrer, error) {
+	log.G(ctx).WithField("subject", subject).WithField("limit", limit).Debug("ecr.referrers: scanning untagged images")
+	ids, err := b.untaggedImages(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	images, err := b.batchGetImages(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	filter := referrerFilter{artifactType: artifactType}
+	for _, image := range images {
+		body := aws.StringValue(image.ImageManifest)
+		manifest, err := parseReferrerManifest(ctx, body)
+		if err != nil || manifest.Subject == nil || manifest.Subject.Digest != subject {
+			continue
+		}
+		filter.add(manifest.referrer(body))
+	}
+	return filter.referrers, nil
+}
+
+// untaggedImages lists the identifiers of the untagged images in the
+// repository.  If limit is positive, at most limit images are listed.
+func (b *ecrBase) untaggedImages(ctx context.Context, limit int) ([]*ecr.ImageIdentifier, error) {
+	var ids []*ecr.ImageIdentifier
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(b.ecrSpec.Registry()),
+		RepositoryName: aws.String(b.ecrSpec.Repository),
+		Filter:         &ecr.DescribeImagesFilter{TagStatus: aws.String(ecr.TagStatusUntagged)},
+	}
+	if limit > 0 && limit < describeImagesLimit {
+		input.MaxResults = aws.Int64(int64(limit))
+	}
+	for {
+		output, err := b.client.DescribeImagesWithContext(ctx, input)
+		if err != nil {
+			return nil, ecrerr.FromAWSError("DescribeImages", err)
+		}
+		for _, detail := range output.ImageDetails {
+			ids = append(ids, &ecr.ImageIdentifier{ImageDigest: detail.ImageDigest})
+		}
+		if limit > 0 && len(ids) >= limit {
+			return ids[:limit], nil
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return ids, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+// batchGetImages retrieves the images with the given identifiers, in batches
+// as large as BatchGetImage allows.  Images that are not found are omitted.
+func (b *ecrBase) batchGetImages(ctx context.Context, ids []*ecr.ImageIdentifier) ([]*ecr.Image, error) {
+	var images []*ecr.Image
+	acceptedMediaTypes := append([]string{mediaTypeArtifactManifest}, supportedImageMediaTypes...)
+	for start := 0; start < len(ids); start += batchGetImageLimit {
+		end := start + batchGetImageLimit
+		if end > len(ids) {
+			end = len(ids)
+		}
+		output, err := b.client.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         aws.String(b.ecrSpec.Registry()),
+			RepositoryName:     aws.String(b.ecrSpec.Repository),
+			ImageIds:           ids[start:end],
+			AcceptedMediaTypes: aws.StringSlice(acceptedMediaTypes),
+		})
+		if err != nil {
+			return nil, ecrerr.FromAWSError("BatchGetImage", err)
+		}
+		for _, failure := range output.Failures {
+			if err := ecrerr.FromImageFailure("BatchGetImage", failure); !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+		}
+		images = append(images, output.Images...)
+	}
+	return images, nil
+}
+
+// referrersIndex is an image index listing the referrers of a subject.
+type referrersIndex struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	MediaType     string     `json:"mediaType"`
+	Manifests     []Referrer `json:"manifests"`
+}
+
+// addReferrer adds the manifest body to the image index listing the
+// referrers of its subject, creating the index if necessary, so that the
+// manifest can be found by clients using the referrers tag schema.  Amazon
+// ECR cannot update a tag conditionally, so referrers of the same subject
+// pushed at the same time may overwrite each other in the index; they are
+// still found by scanning the untagged images of the repository.  In repositories with tag
+// immutability, the index cannot be updated once it has been created, and
+// PutImage fails with ImageTagAlreadyExistsException.
+func (b *ecrBase) addReferrer(ctx context.Context, manifest referrerManifest, body string) error {
+	subject := manifest.Subject.Digest
+	if err := subject.Validate(); err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.referrers: invalid subject digest %q: %v", subject, err)
+	}
+	tag := referrersTag(subject)
+	index := referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageIndex,
+	}
+	image, err := b.getImage(ctx, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if err == nil && image != nil {
+		if err := json.Unmarshal([]byte(aws.StringValue(image.ImageManifest)), &index); err != nil {
+			return errors.Wrapf(err, "ecr.referrers: invalid referrers index %v", tag)
+		}
+	}
+
+	referrer := manifest.referrer(body)
+	for _, existing := range index.Manifests {
+		if existing.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+	indexBody, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	log.G(ctx).
+		WithField("tag", tag).
+		WithField("referrer", referrer.Digest).
+		Debug("ecr.referrers: updating referrers index")
+	_, err = b.client.PutImageWithContext(ctx, &ecr.PutImageInput{
+		RegistryId:     aws.String(b.ecrSpec.Registry()),
+		RepositoryName: aws.String(b.ecrSpec.Repository),
+		ImageManifest:  aws.String(string(indexBody)),
+		ImageTag:       aws.String(tag),
+	})
+	if err != nil {
+		return ecrerr.FromAWSError("PutImage", err)
+	}
+	return nil
+}
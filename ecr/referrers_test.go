@@ -0,0 +1,353 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeImageStore backs BatchGetImage and PutImage with manifests held in
+// memory, keyed by tag and by digest.
+type fakeImageStore struct {
+	manifests map[string]string
+	puts      []*ecr.PutImageInput
+}
+
+func (s *fakeImageStore) add(tag, manifest string) digest.Digest {
+	dgst := digest.FromString(manifest)
+	s.manifests[dgst.String()] = manifest
+	if tag != "" {
+		s.manifests[tag] = manifest
+	}
+	return dgst
+}
+
+func (s *fakeImageStore) client() *fakeECRClient {
+	return &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			output := &ecr.BatchGetImageOutput{}
+			for _, id := range input.ImageIds {
+				key := aws.StringValue(id.ImageTag)
+				if key == "" {
+					key = aws.StringValue(id.ImageDigest)
+				}
+				manifest, ok := s.manifests[key]
+				if !ok {
+					output.Failures = append(output.Failures, &ecr.ImageFailure{
+						ImageId:     id,
+						FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound),
+					})
+					continue
+				}
+				output.Images = append(output.Images, &ecr.Image{
+					ImageId: &ecr.ImageIdentifier{
+						ImageDigest: aws.String(digest.FromString(manifest).String()),
+						ImageTag:    id.ImageTag,
+					},
+					ImageManifest: aws.String(manifest),
+				})
+			}
+			return output, nil
+		},
+		PutImageFn: func(_ aws.Context, input *ecr.PutImageInput, _ ...request.Option) (*ecr.PutImageOutput, error) {
+			s.puts = append(s.puts, input)
+			dgst := s.add(aws.StringValue(input.ImageTag), aws.StringValue(input.ImageManifest))
+			return &ecr.PutImageOutput{
+				Image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String(dgst.String())}},
+			}, nil
+		},
+	}
+}
+
+func referrerManifestJSON(t *testing.T, artifactType string, subject digest.Digest) string {
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"config": ocispec.Descriptor{
+			MediaType: artifactType,
+			Digest:    digest.FromString(artifactType),
+			Size:      2,
+		},
+		"layers": []ocispec.Descriptor{},
+	}
+	if subject != "" {
+		manifest["subject"] = ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    subject,
+			Size:      10,
+		}
+	}
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestReferrers(t *testing.T) {
+	subject := digest.FromString("subject manifest")
+	other := digest.FromString("other manifest")
+	store := &fakeImageStore{manifests: map[string]string{}}
+
+	// listed in the referrers index
+	indexed := referrerManifestJSON(t, "application/vnd.example.sbom", subject)
+	index, err := json.Marshal(referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageIndex,
+		Manifests: []Referrer{{
+			Descriptor: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(indexed),
+				Size:      int64(len(indexed)),
+			},
+			ArtifactType: "application/vnd.example.sbom",
+		}},
+	})
+	require.NoError(t, err)
+	store.add("sha256-"+subject.Hex(), string(index))
+	indexedDigest := store.add("", indexed)
+	// tagged by cosign
+	signatureDigest := store.add("sha256-"+subject.Hex()+".sig", referrerManifestJSON(t, "application/vnd.example.signature", ""))
+	// untagged, with and without a subject
+	untaggedDigest := store.add("", referrerManifestJSON(t, "application/vnd.example.attestation", subject))
+	otherDigest := store.add("", referrerManifestJSON(t, "application/vnd.example.attestation", other))
+	imageDigest := store.add("", `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+
+	client := store.client()
+	describeCalls := 0
+	client.DescribeImagesFn = func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+		describeCalls++
+		assert.Equal(t, ecr.TagStatusUntagged, aws.StringValue(input.Filter.TagStatus))
+		// return the untagged images over two pages
+		if aws.StringValue(input.NextToken) == "" {
+			return &ecr.DescribeImagesOutput{
+				ImageDetails: []*ecr.ImageDetail{
+					{ImageDigest: aws.String(indexedDigest.String())},
+					{ImageDigest: aws.String(untaggedDigest.String())},
+				},
+				NextToken: aws.String("next"),
+			}, nil
+		}
+		return &ecr.DescribeImagesOutput{
+			ImageDetails: []*ecr.ImageDetail{
+				{ImageDigest: aws.String(otherDigest.String())},
+				{ImageDigest: aws.String(imageDigest.String())},
+			},
+		}, nil
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			"fake": client,
+		},
+	}
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar"
+
+	check := func(t *testing.T, artifactType string, expected []digest.Digest) {
+		referrers, err := resolver.Referrers(context.Background(), ref, subject, artifactType)
+		require.NoError(t, err)
+		var digests []digest.Digest
+		for _, referrer := range referrers {
+			digests = append(digests, referrer.Digest)
+			if artifactType != "" {
+				assert.Equal(t, artifactType, referrer.ArtifactType)
+			}
+		}
+		assert.ElementsMatch(t, expected, digests)
+	}
+
+	// the untagged images are not scanned when the tags list referrers,
+	// even if none of them has the artifact type
+	for _, tc := range []struct {
+		artifactType string
+		expected     []digest.Digest
+	}{
+		{"", []digest.Digest{indexedDigest, signatureDigest}},
+		{"application/vnd.example.sbom", []digest.Digest{indexedDigest}},
+		{"application/vnd.example.attestation", nil},
+		{"application/vnd.example.unknown", nil},
+	} {
+		t.Run(fmt.Sprintf("tagged/artifactType=%q", tc.artifactType), func(t *testing.T) {
+			describeCalls = 0
+			check(t, tc.artifactType, tc.expected)
+			assert.Equal(t, 0, describeCalls, "untagged images should not be scanned")
+		})
+	}
+
+	// referrers pushed by clients that do not maintain the index are found
+	// by scanning the untagged images
+	delete(store.manifests, "sha256-"+subject.Hex())
+	delete(store.manifests, "sha256-"+subject.Hex()+".sig")
+	for _, tc := range []struct {
+		artifactType string
+		expected     []digest.Digest
+	}{
+		{"", []digest.Digest{indexedDigest, untaggedDigest}},
+		{"application/vnd.example.attestation", []digest.Digest{untaggedDigest}},
+		{"application/vnd.example.unknown", nil},
+	} {
+		t.Run(fmt.Sprintf("untagged/artifactType=%q", tc.artifactType), func(t *testing.T) {
+			describeCalls = 0
+			check(t, tc.artifactType, tc.expected)
+			assert.Equal(t, 2, describeCalls, "DescribeImages should be paged")
+		})
+	}
+}
+
+func TestReferrersInvalidSubject(t *testing.T) {
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			// the API is not called, so the nil functions do not panic
+			"fake": &fakeECRClient{},
+		},
+	}
+	_, err := resolver.Referrers(context.Background(), "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar", "invalid", "")
+	assert.Error(t, err)
+}
+
+func TestManifestWriterCommitReferrer(t *testing.T) {
+	subject := digest.FromString("subject manifest")
+	store := &fakeImageStore{manifests: map[string]string{}}
+	existing := referrerManifestJSON(t, "application/vnd.example.sbom", subject)
+	index, err := json.Marshal(referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageIndex,
+		Manifests: []Referrer{{
+			Descriptor: ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(existing),
+				Size:      int64(len(existing)),
+			},
+			ArtifactType: "application/vnd.example.sbom",
+		}},
+	})
+	require.NoError(t, err)
+	store.add("sha256-"+subject.Hex(), string(index))
+
+	manifest := referrerManifestJSON(t, "application/vnd.example.signature", subject)
+	mw := &manifestWriter{
+		base: &ecrBase{
+			client: store.client(),
+			ecrSpec: ECRSpec{
+				Repository: "repository",
+				Object:     "signature",
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ref:     "refKey",
+		ctx:     context.Background(),
+	}
+	_, err = mw.Write([]byte(manifest))
+	require.NoError(t, err)
+	require.NoError(t, mw.Commit(context.Background(), int64(len(manifest)), digest.FromString(manifest)))
+
+	require.Len(t, store.puts, 2, "the manifest and the referrers index should be put")
+	assert.Equal(t, manifest, aws.StringValue(store.puts[0].ImageManifest))
+	assert.Equal(t, "sha256-"+subject.Hex(), aws.StringValue(store.puts[1].ImageTag))
+	var updated referrersIndex
+	require.NoError(t, json.Unmarshal([]byte(aws.StringValue(store.puts[1].ImageManifest)), &updated))
+	assert.Equal(t, ocispec.MediaTypeImageIndex, updated.MediaType)
+	require.Len(t, updated.Manifests, 2)
+	assert.Equal(t, digest.FromString(existing), updated.Manifests[0].Digest)
+	assert.Equal(t, digest.FromString(manifest), updated.Manifests[1].Digest)
+	assert.Equal(t, int64(len(manifest)), updated.Manifests[1].Size)
+	assert.Equal(t, "application/vnd.example.signature", updated.Manifests[1].ArtifactType)
+
+	// pushing the same referrer again leaves the index alone
+	store.puts = nil
+	mw.buf.Reset()
+	_, err = mw.Write([]byte(manifest))
+	require.NoError(t, err)
+	require.NoError(t, mw.Commit(context.Background(), int64(len(manifest)), digest.FromString(manifest)))
+	assert.Len(t, store.puts, 1, "the referrers index should not be updated")
+}
+
+func TestManifestWriterCommitReferrerIndexFailure(t *testing.T) {
+	subject := digest.FromString("subject manifest")
+	store := &fakeImageStore{manifests: map[string]string{}}
+	store.add("sha256-"+subject.Hex(), `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+	client := store.client()
+	putImage := client.PutImageFn
+	// the repository has tag immutability, so the index cannot be updated
+	client.PutImageFn = func(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+		if aws.StringValue(input.ImageTag) == "sha256-"+subject.Hex() {
+			return nil, awserr.New(ecr.ErrCodeImageTagAlreadyExistsException, "tag is immutable", nil)
+		}
+		return putImage(ctx, input, opts...)
+	}
+
+	manifest := referrerManifestJSON(t, "application/vnd.example.signature", subject)
+	mw := &manifestWriter{
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				Repository: "repository",
+				Object:     "signature",
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ref:     "refKey",
+		ctx:     context.Background(),
+	}
+	_, err := mw.Write([]byte(manifest))
+	require.NoError(t, err)
+	err = mw.Commit(context.Background(), int64(len(manifest)), digest.FromString(manifest))
+	assert.NoError(t, err, "the push should succeed when the referrers index cannot be updated")
+	require.Len(t, store.puts, 1)
+	assert.Equal(t, manifest, aws.StringValue(store.puts[0].ImageManifest))
+}
+
+func TestManifestWriterCommitReferrerUntagged(t *testing.T) {
+	subject := digest.FromString("subject manifest")
+	store := &fakeImageStore{manifests: map[string]string{}}
+	client := store.client()
+
+	manifest := referrerManifestJSON(t, "application/vnd.example.signature", subject)
+	mw := &manifestWriter{
+		base: &ecrBase{
+			client: client,
+			ecrSpec: ECRSpec{
+				Repository: "repository",
+				Object:     "latest",
+			},
+		},
+		tracker: docker.NewInMemoryTracker(),
+		ref:     "refKey",
+		ctx:     context.Background(),
+	}
+	_, err := mw.Write([]byte(manifest))
+	require.NoError(t, err)
+	err = mw.Commit(context.Background(), int64(len(manifest)), digest.FromString(manifest))
+	require.NoError(t, err)
+
+	// the signature is pushed untagged, then recorded in the referrers index
+	require.Len(t, store.puts, 2)
+	assert.Equal(t, manifest, aws.StringValue(store.puts[0].ImageManifest))
+	assert.Nil(t, store.puts[0].ImageTag, "manifests with a subject should not take the tag")
+	assert.Equal(t, "sha256-"+subject.Hex(), aws.StringValue(store.puts[1].ImageTag))
+	_, ok := store.manifests["latest"]
+	assert.False(t, ok, "the tag should not move onto the signature")
+}
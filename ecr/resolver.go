@@ -19,12 +19,15 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
 	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
 	ecrsdk "github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
@@ -35,14 +38,27 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-var unimplemented = errors.New("unimplemented")
-
 type ecrResolver struct {
 	session                  *session.Session
-	clients                  map[string]ecrAPI
+	clients                  map[string]ECRClient
 	clientsLock              sync.Mutex
 	tracker                  docker.StatusTracker
+	httpClient               *http.Client
+	foreignLayerHosts        []string
 	layerDownloadParallelism int
+	layerDownloadChunkSize   int64
+	layerDownloadMemoryLimit int64
+	layerUploadReadAhead     int
+	layerUploadMemoryLimit   int64
+	retryPolicy              RetryPolicy
+	uploadStore              UploadStore
+	pushNonDistributable     bool
+	verifier                 Verifier
+	policy                   *Policy
+	publicResolver           remotes.Resolver
+	endpointFunc             EndpointFunc
+	clientFactory            ClientFactory
+	childManifests           *childManifests
 }
 
 // ResolverOption represents a functional option for configuring the ECR
@@ -57,10 +73,57 @@ type ResolverOptions struct {
 	// Tracker is used to track uploads to ECR.  If not specified, an in-memory
 	// tracker is used instead.
 	Tracker docker.StatusTracker
+	// HTTPClient is used to download layer content from the URLs returned by
+	// Amazon ECR and from the URLs of foreign layers.  If not specified,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// ForeignLayerHosts are the host patterns that foreign layers may be
+	// downloaded from.  If not specified, foreign layers may be downloaded
+	// from any host.
+	ForeignLayerHosts []string
 	// LayerDownloadParallelism configures whether layer parts should be
 	// downloaded in parallel.  If not specified, parallelism is currently
 	// disabled.
 	LayerDownloadParallelism int
+	// LayerDownloadChunkSize is the size in bytes of the ranges requested when
+	// layers are downloaded in parallel.  If not specified, 8 MiB is used.
+	LayerDownloadChunkSize int64
+	// LayerDownloadMemoryLimit is the maximum number of bytes buffered in
+	// memory for each layer downloaded in parallel.  If not specified, the
+	// limit is LayerDownloadParallelism times LayerDownloadChunkSize.
+	LayerDownloadMemoryLimit int64
+	// LayerUploadReadAhead is the number of layer parts read ahead of the
+	// part being uploaded.  If not specified, 5 parts are read ahead.
+	LayerUploadReadAhead int
+	// LayerUploadMemoryLimit is the maximum number of bytes buffered in
+	// memory for each layer being uploaded.  If not specified, the parts read
+	// ahead are not limited by size.
+	LayerUploadMemoryLimit int64
+	// RetryPolicy configures how layer part uploads and layer downloads are
+	// retried after transient failures.  If not specified, failed parts and
+	// downloads are not retried.
+	RetryPolicy RetryPolicy
+	// UploadStore is used to record the state of layer uploads so that they
+	// can be continued after a failure.  If not specified, layer uploads
+	// always start from the beginning.
+	UploadStore UploadStore
+	// PushNonDistributableLayers configures whether foreign and
+	// non-distributable layers are uploaded when pushing.  If not specified,
+	// they are skipped.
+	PushNonDistributableLayers bool
+	// Verifier is used to verify images before Resolve returns them.  If not
+	// specified, images are not verified.
+	Verifier Verifier
+	// Policy restricts the repositories that can be pulled from and pushed
+	// to.  If not specified, all repositories are allowed.
+	Policy *Policy
+	// EndpointFunc selects the Amazon ECR API endpoint for each registry.  If
+	// not specified, the endpoint is chosen from the region and the
+	// hostname of the ref.
+	EndpointFunc EndpointFunc
+	// ClientFactory creates the Amazon ECR clients used by the resolver.  If
+	// not specified, clients are created from the Session.
+	ClientFactory ClientFactory
 }
 
 // WithSession is a ResolverOption to use a specific AWS session.Session
@@ -79,11 +142,103 @@ func WithTracker(tracker docker.StatusTracker) ResolverOption {
 	}
 }
 
+// WithEndpoint is a ResolverOption to send all Amazon ECR API calls to a
+// specific endpoint URL, such as "http://localhost:4566" for LocalStack or
+// an ECR-compatible test stack.  The region of each ref is still used to sign
+// requests.
+func WithEndpoint(endpoint string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q: must be an http or https URL", endpoint)
+		}
+		options.EndpointFunc = func(ECRSpec) string {
+			return endpoint
+		}
+		return nil
+	}
+}
+
+// WithEndpointFunc is a ResolverOption to choose the Amazon ECR API endpoint
+// for each registry, for example by region or account.  Returning "" from the
+// function uses the default endpoint for that registry.
+func WithEndpointFunc(endpointFunc EndpointFunc) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.EndpointFunc = endpointFunc
+		return nil
+	}
+}
+
+// ClientFactory returns the ECRClient to use for the registry with the given
+// account ID in region.
+type ClientFactory func(region, registry string) ECRClient
+
+// WithClientFactory is a ResolverOption to create the Amazon ECR clients used
+// by the resolver with factory instead of the AWS SDK, for example to use a
+// fake in tests or to wrap the SDK client with caching or instrumentation.
+// The factory is called once for each region and registry, and takes
+// precedence over the Session, WithEndpoint, and WithEndpointFunc.
+func WithClientFactory(factory ClientFactory) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.ClientFactory = factory
+		return nil
+	}
+}
+
+// WithHTTPClient is a ResolverOption to download layers with a specific
+// http.Client, for both single-request and parallel downloads.  The client
+// can configure proxies, TLS settings such as a custom CA bundle, connection
+// pooling, and timeouts.  Calls to the Amazon ECR API are made by the AWS
+// session and are not affected.
+func WithHTTPClient(client *http.Client) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.HTTPClient = client
+		return nil
+	}
+}
+
+// WithHTTPTransport is a ResolverOption to download layers through a specific
+// http.RoundTripper, for example an *http.Transport with custom dial and
+// response header timeouts, or middleware that logs each request.  It is
+// equivalent to WithHTTPClient with a client using the transport.
+func WithHTTPTransport(transport http.RoundTripper) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.HTTPClient = &http.Client{Transport: transport}
+		return nil
+	}
+}
+
+// WithForeignLayerHosts is a ResolverOption to restrict the hosts that
+// foreign layers may be downloaded from.  Foreign layers are downloaded from
+// the URLs listed in the image manifest, so without a restriction, a manifest
+// can direct the resolver to any host.  Each pattern is matched against the
+// host name of a URL using path.Match, so "*.example.com" matches any
+// subdomain of example.com.  Matching is case-insensitive.  URLs with hosts
+// that do not match any pattern are skipped.
+func WithForeignLayerHosts(patterns ...string) ResolverOption {
+	return func(options *ResolverOptions) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid foreign layer host pattern %q: %v", pattern, err)
+			}
+		}
+		options.ForeignLayerHosts = append(options.ForeignLayerHosts, patterns...)
+		return nil
+	}
+}
+
 // WithLayerDownloadParallelism is a ResolverOption to configure whether layer
-// parts should be downloaded in parallel.  Layer parallelism is backed by the
-// htcat library and can increase the speed at which layers are downloaded at
-// the cost of increased memory consumption.  It is recommended to test your
-// workload to determine whether the tradeoff is worthwhile.
+// parts should be downloaded in parallel.  Layers are divided into ranges of
+// the chunk size, and up to parallelism ranges are requested at the same time
+// and reassembled in order.  Parallelism can increase the speed at which
+// layers are downloaded at the cost of buffering ranges in memory.  It is
+// recommended to test your workload to determine whether the tradeoff is
+// worthwhile.  Amazon ECR Public images are downloaded through the registry
+// API, which parallelism does not apply to, so Resolve and Fetcher fail for
+// them when it is set.
 func WithLayerDownloadParallelism(parallelism int) ResolverOption {
 	return func(options *ResolverOptions) error {
 		options.LayerDownloadParallelism = parallelism
@@ -91,11 +246,145 @@ func WithLayerDownloadParallelism(parallelism int) ResolverOption {
 	}
 }
 
+// WithLayerDownloadChunkSize is a ResolverOption to configure the size in
+// bytes of the ranges requested when layers are downloaded in parallel.
+// Layers no larger than a single chunk are downloaded with one request.  Like
+// WithLayerDownloadParallelism, it does not apply to Amazon ECR Public, and
+// Resolve and Fetcher fail for public images when it is set.
+func WithLayerDownloadChunkSize(size int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if size < 0 {
+			return errors.New("layer download chunk size must not be negative")
+		}
+		options.LayerDownloadChunkSize = size
+		return nil
+	}
+}
+
+// WithLayerDownloadMemoryLimit is a ResolverOption to set a hard limit on the
+// number of bytes buffered in memory for each layer downloaded in parallel.
+// Ranges that have been downloaded but not yet consumed count against the
+// limit, so when the consumer falls behind, fewer ranges are requested at the
+// same time.  The limit must be at least the chunk size.  Like
+// WithLayerDownloadParallelism, it does not apply to Amazon ECR Public, and
+// Resolve and Fetcher fail for public images when it is set.
+func WithLayerDownloadMemoryLimit(limit int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if limit < 0 {
+			return errors.New("layer download memory limit must not be negative")
+		}
+		options.LayerDownloadMemoryLimit = limit
+		return nil
+	}
+}
+
+// WithLayerUploadReadAhead is a ResolverOption to configure how many layer
+// parts are read and hashed ahead of the part being uploaded.  It does not
+// upload parts concurrently: Amazon ECR requires the parts of a layer to be
+// uploaded consecutively, so parts are always uploaded one at a time and in
+// order, and reading ahead only keeps the next part ready as soon as the
+// previous one is acknowledged.  Each part read ahead is held in memory, so
+// memory consumption grows with the number of parts and the part size
+// requested by Amazon ECR; see WithLayerUploadMemoryLimit.  If not specified,
+// 5 parts are read ahead.
+func WithLayerUploadReadAhead(parts int) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if parts < 0 {
+			return errors.New("layer upload read ahead must not be negative")
+		}
+		options.LayerUploadReadAhead = parts
+		return nil
+	}
+}
+
+// WithLayerUploadMemoryLimit is a ResolverOption to set a hard limit on the
+// number of bytes buffered in memory for each layer being uploaded.  Fewer
+// parts are read ahead when the parts would not fit within the limit.  The
+// part size is chosen by Amazon ECR when an upload is initiated, and uploads
+// fail if the limit is smaller than two parts: the part being uploaded and the
+// part being read.
+func WithLayerUploadMemoryLimit(limit int64) ResolverOption {
+	return func(options *ResolverOptions) error {
+		if limit < 0 {
+			return errors.New("layer upload memory limit must not be negative")
+		}
+		options.LayerUploadMemoryLimit = limit
+		return nil
+	}
+}
+
+// WithRetryPolicy is a ResolverOption to retry layer part uploads and layer
+// downloads that fail with a transient error, such as throttling, a 5xx
+// response, or a dropped connection.  Retries are delayed with exponential
+// backoff and jitter.  Uploads retry only the failed part, and downloads
+// resume from the last byte received.  Amazon ECR Public images are
+// downloaded through the registry API, which is not retried, so Resolve and
+// Fetcher fail for them when the policy allows retries.
+func WithRetryPolicy(policy RetryPolicy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.RetryPolicy = policy
+		return nil
+	}
+}
+
+// WithUploadStore is a ResolverOption to record the state of layer uploads in
+// the given UploadStore.  When a push is restarted, including from another
+// process sharing the same store, layers that were partially uploaded are
+// continued from the last part acknowledged by Amazon ECR instead of being
+// uploaded again.  Amazon ECR expires uploads that are not completed, in
+// which case the layer is uploaded from the beginning on the next push.
+func WithUploadStore(store UploadStore) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.UploadStore = store
+		return nil
+	}
+}
+
+// WithPushNonDistributableLayers is a ResolverOption to configure whether
+// foreign and non-distributable layers, such as Windows base layers, are
+// uploaded when pushing.  By default they are skipped, matching the Docker
+// pusher, and clients pulling the image download them from the URLs in the
+// manifest.  Uploading them is useful for mirrors in air-gapped environments,
+// and should only be enabled when the license terms of the layers allow it.
+func WithPushNonDistributableLayers(push bool) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.PushNonDistributableLayers = push
+		return nil
+	}
+}
+
+// WithVerifier is a ResolverOption to verify every image before Resolve
+// returns it.  The verifier receives the resolved descriptor and manifest, and
+// Resolve fails with its error if it rejects the image, so nothing is pulled
+// from an image that does not pass verification.  NewSignatureVerifier
+// provides a verifier checking detached signatures.
+func WithVerifier(verifier Verifier) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Verifier = verifier
+		return nil
+	}
+}
+
+// WithPolicy is a ResolverOption to restrict the accounts, regions, and
+// repositories that the resolver may pull from or push to.  The policy is
+// evaluated against the parsed ref in Resolve, Fetcher, Pusher, and
+// Referrers, before any request is made, and denials are returned as a
+// *PolicyError.
+func WithPolicy(policy Policy) ResolverOption {
+	return func(options *ResolverOptions) error {
+		options.Policy = &policy
+		return nil
+	}
+}
+
 // NewResolver creates a new remotes.Resolver capable of interacting with Amazon
 // ECR.  NewResolver can be called with no arguments for default configuration,
 // or can be customized by specifying ResolverOptions.  By default, NewResolver
 // will allocate a new AWS session.Session and an in-memory tracker for layer
-// progress.
+// progress.  To push multi-platform images, pass a handler from PushHandler to
+// the push; without it, the platform-specific manifests are pushed with the
+// tag of the ref, which moves onto each of them in turn until the index is
+// pushed.
 func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
 	resolverOptions := &ResolverOptions{}
 	for _, option := range options {
@@ -104,7 +393,7 @@ func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
 			return nil, err
 		}
 	}
-	if resolverOptions.Session == nil {
+	if resolverOptions.Session == nil && resolverOptions.ClientFactory == nil {
 		awsSession, err := session.NewSession()
 		if err != nil {
 			return nil, err
@@ -114,18 +403,46 @@ func NewResolver(options ...ResolverOption) (remotes.Resolver, error) {
 	if resolverOptions.Tracker == nil {
 		resolverOptions.Tracker = docker.NewInMemoryTracker()
 	}
+	if resolverOptions.LayerDownloadMemoryLimit > 0 {
+		chunkSize := resolverOptions.LayerDownloadChunkSize
+		if chunkSize == 0 {
+			chunkSize = defaultLayerDownloadChunkSize
+		}
+		if resolverOptions.LayerDownloadMemoryLimit < chunkSize {
+			return nil, fmt.Errorf("layer download memory limit %d is smaller than the chunk size %d",
+				resolverOptions.LayerDownloadMemoryLimit, chunkSize)
+		}
+	}
 	return &ecrResolver{
 		session:                  resolverOptions.Session,
-		clients:                  map[string]ecrAPI{},
+		clients:                  map[string]ECRClient{},
 		tracker:                  resolverOptions.Tracker,
+		httpClient:               resolverOptions.HTTPClient,
+		foreignLayerHosts:        resolverOptions.ForeignLayerHosts,
 		layerDownloadParallelism: resolverOptions.LayerDownloadParallelism,
+		layerDownloadChunkSize:   resolverOptions.LayerDownloadChunkSize,
+		layerDownloadMemoryLimit: resolverOptions.LayerDownloadMemoryLimit,
+		layerUploadReadAhead:     resolverOptions.LayerUploadReadAhead,
+		layerUploadMemoryLimit:   resolverOptions.LayerUploadMemoryLimit,
+		retryPolicy:              resolverOptions.RetryPolicy,
+		uploadStore:              resolverOptions.UploadStore,
+		pushNonDistributable:     resolverOptions.PushNonDistributableLayers,
+		verifier:                 resolverOptions.Verifier,
+		policy:                   resolverOptions.Policy,
+		endpointFunc:             resolverOptions.EndpointFunc,
+		clientFactory:            resolverOptions.ClientFactory,
+		childManifests:           newChildManifests(),
 	}, nil
 }
 
 // Resolve attempts to resolve the provided reference into a name and a
 // descriptor.
 //
-// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>".
+// Valid references are of the form "ecr.aws/arn:aws:ecr:<region>:<account>:repository/<name>:<tag>"
+// or "<account>.dkr.ecr.<region>.amazonaws.com/<name>:<tag>".  References to
+// Amazon ECR Public, "public.ecr.aws/<alias>/<name>:<tag>", are resolved
+// anonymously through the registry API.  The returned name has the same form
+// as the reference.
 func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
 	ecrSpec, err := ParseRef(ref)
 	if err != nil {
@@ -135,20 +452,18 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 	if ecrSpec.Object == "" {
 		return "", ocispec.Descriptor{}, reference.ErrObjectRequired
 	}
-
-	batchGetImageInput := &ecr.BatchGetImageInput{
-		RegistryId:     aws.String(ecrSpec.Registry()),
-		RepositoryName: aws.String(ecrSpec.Repository),
-		ImageIds:       []*ecr.ImageIdentifier{ecrSpec.ImageID()},
-		AcceptedMediaTypes: []*string{
-			aws.String(ocispec.MediaTypeImageManifest),
-			aws.String(images.MediaTypeDockerSchema2Manifest),
-		},
+	if err := r.checkPolicy(ctx, ecrSpec, PolicyOperationPull); err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	if ecrSpec.Public() {
+		return r.resolvePublic(ctx, ref, ecrSpec)
 	}
 
-	client := r.getClient(ecrSpec.Region())
-
-	batchGetImageOutput, err := client.BatchGetImageWithContext(ctx, batchGetImageInput)
+	base := ecrBase{
+		client:  r.getClient(ecrSpec),
+		ecrSpec: ecrSpec,
+	}
+	ecrImage, err := base.getManifest(ctx)
 	if err != nil {
 		log.G(ctx).
 			WithField("ref", ref).
@@ -158,15 +473,11 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 	}
 	log.G(ctx).
 		WithField("ref", ref).
-		WithField("batchGetImageOutput", batchGetImageOutput).
+		WithField("image", ecrImage).
 		Debug("ecr.resolver.resolve")
 
-	var ecrImage *ecr.Image
-	if len(batchGetImageOutput.Images) == 0 {
-		return "", ocispec.Descriptor{}, reference.ErrInvalid
-	}
-	ecrImage = batchGetImageOutput.Images[0]
-	mediaType := parseImageManifestMediaType(ctx, aws.StringValue(ecrImage.ImageManifest))
+	manifest := aws.StringValue(ecrImage.ImageManifest)
+	mediaType := parseImageManifestMediaType(ctx, manifest)
 	log.G(ctx).
 		WithField("ref", ref).
 		WithField("media type", mediaType).
@@ -174,25 +485,82 @@ func (r *ecrResolver) Resolve(ctx context.Context, ref string) (string, ocispec.
 	desc := ocispec.Descriptor{
 		Digest:    digest.Digest(aws.StringValue(ecrImage.ImageId.ImageDigest)),
 		MediaType: mediaType,
-		Size:      int64(len(aws.StringValue(ecrImage.ImageManifest))),
+		Size:      int64(len(manifest)),
+	}
+
+	if r.verifier != nil {
+		if err := r.verifier.Verify(ctx, ecrSpec, desc, []byte(manifest)); err != nil {
+			log.G(ctx).
+				WithField("ref", ref).
+				WithField("digest", desc.Digest).
+				WithError(err).
+				Warn("ecr.resolver.resolve: image failed verification")
+			return "", ocispec.Descriptor{}, err
+		}
 	}
 
-	return ecrSpec.Canonical(), desc, nil
+	return ecrSpec.name(ref), desc, nil
+}
+
+// checkPolicy returns an error if the policy of the resolver denies op on the
+// ref described by ecrSpec.
+func (r *ecrResolver) checkPolicy(ctx context.Context, ecrSpec ECRSpec, op PolicyOperation) error {
+	if r.policy == nil {
+		return nil
+	}
+	if err := r.policy.check(ecrSpec, op); err != nil {
+		log.G(ctx).WithError(err).Warn("ecr.resolver: denied by policy")
+		return err
+	}
+	return nil
+}
+
+// apiEndpoint returns the URL of the Amazon ECR API endpoint for ecrSpec, or
+// "" to use the default endpoint of the region.  The EndpointFunc of the
+// resolver takes precedence over the endpoint named by the ref.
+func (r *ecrResolver) apiEndpoint(ecrSpec ECRSpec) string {
+	if r.endpointFunc != nil {
+		if endpoint := r.endpointFunc(ecrSpec); endpoint != "" {
+			return endpoint
+		}
+	}
+	return ecrSpec.apiEndpoint()
 }
 
-func (r *ecrResolver) getClient(region string) ecrAPI {
+// getClient returns the client for the Amazon ECR API endpoint of ecrSpec, or
+// the client created by the ClientFactory of the resolver.
+func (r *ecrResolver) getClient(ecrSpec ECRSpec) ECRClient {
 	r.clientsLock.Lock()
 	defer r.clientsLock.Unlock()
-	if _, ok := r.clients[region]; !ok {
-		r.clients[region] = ecrsdk.New(r.session, &aws.Config{Region: aws.String(region)})
+	region := ecrSpec.Region()
+	if r.clientFactory != nil {
+		key := region + " " + ecrSpec.Registry()
+		if _, ok := r.clients[key]; !ok {
+			r.clients[key] = r.clientFactory(region, ecrSpec.Registry())
+		}
+		return r.clients[key]
+	}
+	endpoint := r.apiEndpoint(ecrSpec)
+	key := region
+	if endpoint != "" {
+		key = region + " " + endpoint
 	}
-	return r.clients[region]
+	if _, ok := r.clients[key]; !ok {
+		config := &aws.Config{Region: aws.String(region)}
+		if endpoint != "" {
+			config.Endpoint = aws.String(endpoint)
+		}
+		r.clients[key] = ecrsdk.New(r.session, config)
+	}
+	return r.clients[key]
 }
 
 type manifestContent struct {
-	SchemaVersion int64         `json:"schemaVersion"`
-	Signatures    []interface{} `json:"signatures,omitempty"`
-	MediaType     string        `json:"mediaType,omitempty"`
+	SchemaVersion int64             `json:"schemaVersion"`
+	Signatures    []interface{}     `json:"signatures,omitempty"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        json.RawMessage   `json:"config,omitempty"`
+	Manifests     []json.RawMessage `json:"manifests,omitempty"`
 }
 
 func parseImageManifestMediaType(ctx context.Context, body string) string {
@@ -204,7 +572,18 @@ func parseImageManifestMediaType(ctx context.Context, body string) string {
 		return images.MediaTypeDockerSchema2Manifest
 	}
 	if manifest.SchemaVersion == 2 {
-		return manifest.MediaType
+		if manifest.MediaType != "" {
+			return manifest.MediaType
+		}
+		// The mediaType field is optional for OCI content, so fall back to
+		// the shape of the document.
+		if manifest.Manifests != nil {
+			return ocispec.MediaTypeImageIndex
+		}
+		if manifest.Config != nil {
+			return ocispec.MediaTypeImageManifest
+		}
+		return ""
 	} else if manifest.SchemaVersion == 1 {
 		if len(manifest.Signatures) == 0 {
 			// unsigned
@@ -223,15 +602,31 @@ func (r *ecrResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher,
 	if err != nil {
 		return nil, err
 	}
+	if err := r.checkPolicy(ctx, ecrSpec, PolicyOperationPull); err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return r.fetcherPublic(ctx, ecrSpec)
+	}
 	return &ecrFetcher{
 		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
+			client:  r.getClient(ecrSpec),
 			ecrSpec: ecrSpec,
 		},
-		parallelism: r.layerDownloadParallelism,
+		httpClient:        r.httpClient,
+		foreignLayerHosts: r.foreignLayerHosts,
+		parallelism:       r.layerDownloadParallelism,
+		chunkSize:         r.layerDownloadChunkSize,
+		memoryLimit:       r.layerDownloadMemoryLimit,
+		retryPolicy:       r.retryPolicy,
 	}, nil
 }
 
+// Pusher returns a pusher for ref.  Manifests are pushed with the tag of the
+// ref, except for manifests with a subject and the children of the indexes
+// recorded by a handler from PushHandler, which are pushed untagged.  Without
+// that handler, the tag moves onto each platform-specific manifest of a
+// multi-platform image in turn until the index is pushed.
 func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
 	log.G(ctx).WithField("ref", ref).Debug("ecr.resolver.pusher")
 	ecrSpec, err := ParseRef(ref)
@@ -244,12 +639,24 @@ func (r *ecrResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, e
 	if ecrSpec.Object != "" && strings.Contains(ecrSpec.Object, "@") {
 		return nil, errors.New("pusher: cannot use digest reference for push location")
 	}
+	if err := r.checkPolicy(ctx, ecrSpec, PolicyOperationPush); err != nil {
+		return nil, err
+	}
+	if ecrSpec.Public() {
+		return nil, errPublicUnsupported("push")
+	}
 
 	return &ecrPusher{
 		ecrBase: ecrBase{
-			client:  r.getClient(ecrSpec.Region()),
+			client:  r.getClient(ecrSpec),
 			ecrSpec: ecrSpec,
 		},
-		tracker: r.tracker,
+		tracker:              r.tracker,
+		uploadReadAhead:      r.layerUploadReadAhead,
+		uploadMemoryLimit:    r.layerUploadMemoryLimit,
+		retryPolicy:          r.retryPolicy,
+		uploadStore:          r.uploadStore,
+		pushNonDistributable: r.pushNonDistributable,
+		childManifests:       r.childManifests,
 	}, nil
 }
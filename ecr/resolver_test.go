@@ -21,13 +21,17 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/reference"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseImageManifestMediaType(t *testing.T) {
@@ -61,6 +65,26 @@ func TestParseImageManifestMediaType(t *testing.T) {
 			manifest:  `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`,
 			mediaType: ocispec.MediaTypeImageManifest,
 		},
+		{
+			name:      "schemaVersion:2 docker manifest list",
+			manifest:  `{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json"}`,
+			mediaType: images.MediaTypeDockerSchema2ManifestList,
+		},
+		{
+			name:      "schemaVersion:2 oci index",
+			manifest:  `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json"}`,
+			mediaType: ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:      "schemaVersion:2 oci index without mediaType",
+			manifest:  `{"schemaVersion": 2, "manifests": []}`,
+			mediaType: ocispec.MediaTypeImageIndex,
+		},
+		{
+			name:      "schemaVersion:2 oci manifest without mediaType",
+			manifest:  `{"schemaVersion": 2, "config": {}, "layers": []}`,
+			mediaType: ocispec.MediaTypeImageManifest,
+		},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -106,7 +130,7 @@ func TestResolve(t *testing.T) {
 		},
 	}
 	resolver := &ecrResolver{
-		clients: map[string]ecrAPI{
+		clients: map[string]ECRClient{
 			"fake": fakeClient,
 		},
 	}
@@ -117,6 +141,37 @@ func TestResolve(t *testing.T) {
 	assert.Equal(t, expectedDesc, desc)
 }
 
+func TestResolveImageURI(t *testing.T) {
+	ref := "123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(_ aws.Context, input *ecr.BatchGetImageInput, _ ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			assert.Equal(t, "123456789012", aws.StringValue(input.RegistryId))
+			assert.Equal(t, "foo/bar", aws.StringValue(input.RepositoryName))
+			assert.Equal(t, "latest", aws.StringValue(input.ImageIds[0].ImageTag))
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:digest")},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			"us-west-2": fakeClient,
+		},
+	}
+
+	name, desc, err := resolver.Resolve(context.Background(), ref)
+	require.NoError(t, err)
+	assert.Equal(t, ref, name, "the name should keep the form of the ref")
+	assert.Equal(t, digest.Digest("sha256:digest"), desc.Digest)
+
+	_, err = resolver.Fetcher(context.Background(), name)
+	assert.NoError(t, err)
+	_, err = resolver.Pusher(context.Background(), ref)
+	assert.NoError(t, err)
+}
+
 func TestResolveError(t *testing.T) {
 	// input
 	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
@@ -130,7 +185,7 @@ func TestResolveError(t *testing.T) {
 		},
 	}
 	resolver := &ecrResolver{
-		clients: map[string]ecrAPI{
+		clients: map[string]ECRClient{
 			"fake": fakeClient,
 		},
 	}
@@ -148,7 +203,7 @@ func TestResolveNoResult(t *testing.T) {
 		},
 	}
 	resolver := &ecrResolver{
-		clients: map[string]ecrAPI{
+		clients: map[string]ECRClient{
 			"fake": fakeClient,
 		},
 	}
@@ -157,9 +212,147 @@ func TestResolveNoResult(t *testing.T) {
 	assert.Equal(t, reference.ErrInvalid, err)
 }
 
+func TestResolveRepositoryNotFound(t *testing.T) {
+	// input
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			"fake": fakeClient,
+		},
+	}
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.Error(t, err)
+	assert.True(t, errdefs.IsNotFound(err), "error should be not found: %v", err)
+}
+
+func TestResolveImageNotFound(t *testing.T) {
+	// input
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{
+				Failures: []*ecr.ImageFailure{
+					{FailureCode: aws.String(ecr.ImageFailureCodeImageNotFound)},
+				},
+			}, nil
+		},
+	}
+	resolver := &ecrResolver{
+		clients: map[string]ECRClient{
+			"fake": fakeClient,
+		},
+	}
+	_, _, err := resolver.Resolve(context.Background(), ref)
+	assert.Error(t, err)
+	assert.True(t, errdefs.IsNotFound(err), "error should be not found: %v", err)
+}
+
 func TestResolvePusherDenyDigest(t *testing.T) {
 	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest@sha256:digest"
 	resolver := &ecrResolver{}
 	_, err := resolver.Pusher(context.Background(), ref)
 	assert.Error(t, err)
 }
+
+func TestNewResolverLayerDownloadMemoryLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []ResolverOption
+		valid   bool
+	}{
+		{"default chunk size", []ResolverOption{WithLayerDownloadMemoryLimit(defaultLayerDownloadChunkSize)}, true},
+		{"smaller than default chunk size", []ResolverOption{WithLayerDownloadMemoryLimit(defaultLayerDownloadChunkSize - 1)}, false},
+		{"custom chunk size", []ResolverOption{WithLayerDownloadChunkSize(1024), WithLayerDownloadMemoryLimit(4096)}, true},
+		{"smaller than custom chunk size", []ResolverOption{WithLayerDownloadChunkSize(4096), WithLayerDownloadMemoryLimit(1024)}, false},
+		{"negative", []ResolverOption{WithLayerDownloadMemoryLimit(-1)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := append([]ResolverOption{WithSession(&session.Session{})}, tc.options...)
+			_, err := NewResolver(options...)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestResolverEndpoint(t *testing.T) {
+	standard, err := ParseRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+	fips, err := ParseRef("123456789012.dkr.ecr-fips.us-west-2.amazonaws.com/foo/bar:latest")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		option   ResolverOption
+		spec     ECRSpec
+		expected string
+	}{
+		{"default", nil, standard, ""},
+		{"named by ref", nil, fips, "https://ecr-fips.us-west-2.amazonaws.com"},
+		{"endpoint", WithEndpoint("http://localhost:4566"), fips, "http://localhost:4566"},
+		{"endpoint func", WithEndpointFunc(func(spec ECRSpec) string {
+			if spec.Registry() == "123456789012" {
+				return "https://ecr.test.example.com"
+			}
+			return ""
+		}), standard, "https://ecr.test.example.com"},
+		{"endpoint func default", WithEndpointFunc(func(ECRSpec) string { return "" }), fips, "https://ecr-fips.us-west-2.amazonaws.com"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := []ResolverOption{WithSession(&session.Session{})}
+			if tc.option != nil {
+				options = append(options, tc.option)
+			}
+			resolver, err := NewResolver(options...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, resolver.(*ecrResolver).apiEndpoint(tc.spec))
+		})
+	}
+
+	for _, endpoint := range []string{"", "localhost:4566", "ftp://localhost", "http://"} {
+		t.Run("invalid-"+endpoint, func(t *testing.T) {
+			_, err := NewResolver(WithSession(&session.Session{}), WithEndpoint(endpoint))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestResolverClientFactory(t *testing.T) {
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:digest")},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+	var calls []string
+	resolver, err := NewResolver(WithClientFactory(func(region, registry string) ECRClient {
+		calls = append(calls, region+"/"+registry)
+		return fakeClient
+	}))
+	require.NoError(t, err)
+
+	for _, ref := range []string{
+		"ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest",
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com/foo/bar:latest",
+		"ecr.aws/arn:aws:ecr:us-west-2:210987654321:repository/foo/bar:latest",
+	} {
+		_, desc, err := resolver.Resolve(context.Background(), ref)
+		require.NoError(t, err)
+		assert.Equal(t, digest.Digest("sha256:digest"), desc.Digest)
+	}
+	assert.Equal(t, []string{"us-west-2/123456789012", "us-west-2/210987654321"}, calls,
+		"a client should be created once for each region and registry")
+}
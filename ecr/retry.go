@@ -0,0 +1,227 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy configures how layer part uploads and layer downloads are
+// retried after a transient failure, such as throttling, a 5xx response, or a
+// dropped connection.  Uploads are retried one part at a time and downloads
+// resume from the last byte received, so a failure does not restart the
+// whole layer.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts made for a single part
+	// or range, including the first attempt.  A value of 1 or less disables
+	// retries.
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the delay before the first retry.
+	// The bound doubles with each subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the upper bound of the delay between retries.  If not
+	// specified, the delay is not capped.
+	MaxBackoff time.Duration
+}
+
+// jitter is the source of the random delays between retries.  The global
+// math/rand source is seeded with 1 before Go 1.20, which would give every
+// process the same delays, so a source seeded at startup is used instead.
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// backoff returns the delay before the given retry, starting at 1.  The delay
+// is chosen at random between zero and the exponential bound ("full jitter")
+// so that clients failing at the same time do not retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	bound := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || bound < p.MaxBackoff); i++ {
+		bound *= 2
+	}
+	if p.MaxBackoff > 0 && bound > p.MaxBackoff {
+		bound = p.MaxBackoff
+	}
+	if bound <= 0 {
+		return 0
+	}
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(jitter.Int63n(int64(bound) + 1))
+}
+
+// wait sleeps before the given retry, returning early with an error if ctx is
+// done.
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(p.backoff(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do calls fn until it succeeds, fails with an error that is not retryable,
+// or the attempts allowed by the policy are exhausted.  The last error is
+// returned.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(ctx, err) {
+			return err
+		}
+		log.G(ctx).
+			WithError(err).
+			WithField("attempt", attempt).
+			Warn("ecr.retry: retrying after transient failure")
+		if werr := p.wait(ctx, attempt); werr != nil {
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether err is a transient failure that may succeed if
+// the operation is attempted again.  Errors are never retryable once ctx is
+// done.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return errdefs.IsUnavailable(err)
+}
+
+// resumableReader is an io.ReadCloser that transparently reopens the
+// underlying stream at the current offset after a transient failure.
+type resumableReader struct {
+	ctx    context.Context
+	policy RetryPolicy
+	// open returns a stream of the content starting at offset.
+	open func(ctx context.Context, offset int64) (io.ReadCloser, error)
+	// size is the expected size of the content, or zero if unknown.  When it
+	// is known, a stream ending early is treated as a transient failure.
+	size int64
+
+	body   io.ReadCloser
+	offset int64
+	// failures counts consecutive failed attempts without progress.
+	failures int
+}
+
+// newResumableReader opens the stream at the start of the content, retrying
+// according to policy, and returns a reader that resumes the stream on
+// failure.
+func newResumableReader(ctx context.Context, policy RetryPolicy, size int64, open func(context.Context, int64) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	rr := &resumableReader{
+		ctx:    ctx,
+		policy: policy,
+		open:   open,
+		size:   size,
+	}
+	err := policy.do(ctx, func() error {
+		body, err := open(ctx, 0)
+		if err != nil {
+			return err
+		}
+		rr.body = body
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+func (rr *resumableReader) Read(p []byte) (int, error) {
+	for {
+		if rr.body == nil {
+			body, err := rr.open(rr.ctx, rr.offset)
+			if err != nil {
+				if rerr := rr.retry(err); rerr != nil {
+					return 0, rerr
+				}
+				continue
+			}
+			rr.body = body
+		}
+
+		n, err := rr.body.Read(p)
+		rr.offset += int64(n)
+		if n > 0 {
+			rr.failures = 0
+		}
+		if err == io.EOF && rr.size > 0 && rr.offset < rr.size {
+			err = errors.Wrapf(errdefs.ErrUnavailable, "unexpected EOF at %d of %d bytes", rr.offset, rr.size)
+		} else if err != nil && err != io.EOF {
+			// errors while reading the body are interrupted connections
+			err = errors.Wrapf(errdefs.ErrUnavailable, "read failed at %d bytes: %v", rr.offset, err)
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		rr.body.Close()
+		rr.body = nil
+		if n > 0 {
+			if rr.policy.MaxAttempts <= 1 || !isRetryable(rr.ctx, err) {
+				return n, err
+			}
+			// hand back what was read; the stream is reopened on the next
+			// call
+			return n, nil
+		}
+		if rerr := rr.retry(err); rerr != nil {
+			return 0, rerr
+		}
+	}
+}
+
+// retry records a failed attempt and waits before the next one, returning a
+// non-nil error if the stream should not be resumed.
+func (rr *resumableReader) retry(err error) error {
+	rr.failures++
+	if rr.failures >= rr.policy.MaxAttempts || !isRetryable(rr.ctx, err) {
+		return err
+	}
+	log.G(rr.ctx).
+		WithError(err).
+		WithField("offset", rr.offset).
+		WithField("attempt", rr.failures).
+		Warn("ecr.retry: resuming download after transient failure")
+	if werr := rr.policy.wait(rr.ctx, rr.failures); werr != nil {
+		return err
+	}
+	return nil
+}
+
+func (rr *resumableReader) Close() error {
+	if rr.body == nil {
+		return nil
+	}
+	err := rr.body.Close()
+	rr.body = nil
+	return err
+}
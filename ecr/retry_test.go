@@ -0,0 +1,165 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     30 * time.Millisecond,
+	}
+	for retry, bound := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 30 * time.Millisecond,
+		8: 30 * time.Millisecond,
+	} {
+		for i := 0; i < 100; i++ {
+			backoff := policy.backoff(retry)
+			assert.True(t, backoff >= 0 && backoff <= bound, "retry %d: backoff %v exceeds %v", retry, backoff, bound)
+		}
+	}
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.backoff(1))
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3}
+	for _, tc := range []struct {
+		name          string
+		err           error
+		expectedCalls int
+	}{
+		{"success", nil, 1},
+		{"unavailable", errors.Wrap(errdefs.ErrUnavailable, "throttled"), 3},
+		{"not found", errors.Wrap(errdefs.ErrNotFound, "missing"), 1},
+		{"unclassified", errors.New("unknown"), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := policy.do(context.Background(), func() error {
+				calls++
+				return tc.err
+			})
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.expectedCalls, calls)
+		})
+	}
+}
+
+func TestRetryPolicyDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err := RetryPolicy{MaxAttempts: 3}.do(ctx, func() error {
+		calls++
+		return errdefs.ErrUnavailable
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFetchLayerURLResume(t *testing.T) {
+	expectedBody := "hello this is dog, resumed"
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		ranges = append(ranges, rangeHeader)
+		if rangeHeader == "" {
+			// promise the whole body, but drop the connection halfway
+			w.Header().Set("Content-Length", strconv.Itoa(len(expectedBody)))
+			fmt.Fprint(w, expectedBody[:10])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		require.NoError(t, err)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(expectedBody)-1, len(expectedBody)))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, expectedBody[offset:])
+	}))
+	defer ts.Close()
+
+	fetcher := &ecrFetcher{retryPolicy: RetryPolicy{MaxAttempts: 2}}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Size:      int64(len(expectedBody)),
+	}
+	reader, err := fetcher.fetchLayerURL(context.Background(), desc, ts.URL)
+	require.NoError(t, err)
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedBody, string(body))
+	assert.Equal(t, []string{"", "bytes=10-"}, ranges)
+}
+
+func TestFetchLayerURLRetryStatus(t *testing.T) {
+	expectedBody := "hello this is dog"
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, expectedBody)
+	}))
+	defer ts.Close()
+
+	fetcher := &ecrFetcher{retryPolicy: RetryPolicy{MaxAttempts: 2}}
+	reader, err := fetcher.fetchLayerURL(context.Background(), ocispec.Descriptor{}, ts.URL)
+	require.NoError(t, err)
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedBody, string(body))
+	assert.Equal(t, 2, calls)
+}
+
+func TestFetchLayerURLNoRetry(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	fetcher := &ecrFetcher{}
+	_, err := fetcher.fetchLayerURL(context.Background(), ocispec.Descriptor{}, ts.URL)
+	assert.Error(t, err)
+	assert.True(t, errdefs.IsUnavailable(err), "error should be unavailable: %v", err)
+	assert.Equal(t, 1, calls)
+}
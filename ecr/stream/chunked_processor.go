@@ -56,8 +56,14 @@ type readCallbackFunc func(*Chunk) error
 // ChunkedProcessor will block waiting until the next readCallback is invoked
 // to read from the queued Chunks.
 //
+// Processing stops when ctx is canceled, and ChunkedProcessor returns the
+// context's error.  Reads already blocked on reader are not interrupted, so
+// callers that read from a pipe should also close it when ctx is canceled.
+//
 // Parameters
 //
+// ctx - the context controlling the lifetime of the processing.
+//
 // reader - the io.Reader to read.
 //
 // chunkSize - the maximum number of bytes that should be present in each chunk.
@@ -66,8 +72,8 @@ type readCallbackFunc func(*Chunk) error
 // queueSize - the maximum number of unprocessed chunks to buffer.
 //
 // readCallback - the callback function to invoke for each chunk.
-func ChunkedProcessor(reader io.Reader, chunkSize int64, queueSize int64, readCallback readCallbackFunc) (int64, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+func ChunkedProcessor(ctx context.Context, reader io.Reader, chunkSize int64, queueSize int64, readCallback readCallbackFunc) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	bufferedReader := &chunkedProcessor{
 		ctx:          ctx,
 		cancel:       cancel,
@@ -109,12 +115,19 @@ func (processor *chunkedProcessor) readIntoChunks() {
 		default:
 			chunk, err := processor.readChunk(currentBytes, currentPart)
 			if err != nil && err != io.EOF {
-				processor.errorChannel <- err
+				select {
+				case processor.errorChannel <- err:
+				case <-processor.ctx.Done():
+				}
 				return
 			}
 
 			if chunk != nil {
-				processor.readChannel <- chunk
+				select {
+				case processor.readChannel <- chunk:
+				case <-processor.ctx.Done():
+					return
+				}
 				currentBytes = chunk.BytesEnd + 1
 				currentPart++
 			}
@@ -130,8 +143,8 @@ func (processor *chunkedProcessor) readIntoChunks() {
 // processChunks selects between the read & error channels provided in the
 // context and invokes the readCallback with the results on success.
 //
-// If an error is received in the error channel or from the read callback,
-// the function returns and cancels the context.
+// If an error is received in the error channel or from the read callback, or
+// the context is canceled, the function returns and cancels the context.
 func (processor *chunkedProcessor) processChunks(readCallback readCallbackFunc) (int64, error) {
 	defer processor.cancel()
 
@@ -142,6 +155,10 @@ func (processor *chunkedProcessor) processChunks(readCallback readCallbackFunc)
 		select {
 		case chunk := <-processor.readChannel:
 			if chunk == nil {
+				// reading also stops when the context is canceled
+				if err := processor.ctx.Err(); err != nil {
+					return 0, err
+				}
 				eof = true
 				break
 			}
@@ -153,6 +170,8 @@ func (processor *chunkedProcessor) processChunks(readCallback readCallbackFunc)
 			}
 		case err := <-processor.errorChannel:
 			return 0, err
+		case <-processor.ctx.Done():
+			return 0, processor.ctx.Err()
 		}
 	}
 
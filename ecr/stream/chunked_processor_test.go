@@ -16,6 +16,7 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"testing"
@@ -28,7 +29,7 @@ var testReaderString = "ABCDEFG"
 
 func TestChunkedProcessorSuccess(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(testReaderString), 1, 10, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(testReaderString), 1, 10, func(b *Chunk) error {
 		assert.Equal(t, testBufferString[index], string(b.Bytes))
 		index += 1
 		return nil
@@ -40,7 +41,7 @@ func TestChunkedProcessorSuccess(t *testing.T) {
 
 func TestChunkedProcessorFail(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(testReaderString), 1, 10, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(testReaderString), 1, 10, func(b *Chunk) error {
 		index += 1
 		return errors.New("error")
 	})
@@ -51,7 +52,7 @@ func TestChunkedProcessorFail(t *testing.T) {
 
 func TestChunkedProcessorBlockingFail(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(testReaderString), 1, 2, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(testReaderString), 1, 2, func(b *Chunk) error {
 		index += 1
 		return errors.New("error")
 	})
@@ -62,7 +63,7 @@ func TestChunkedProcessorBlockingFail(t *testing.T) {
 
 func TestChunkedProcessorBlockingSuccess(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(testReaderString), 1, 2, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(testReaderString), 1, 2, func(b *Chunk) error {
 		assert.Equal(t, testBufferString[index], string(b.Bytes))
 		index += 1
 		return nil
@@ -76,7 +77,7 @@ var testChunkedString = []string{"ABC", "DEF", "G"}
 
 func TestChunkedProcessorChunkingSuccess(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(testReaderString), 3, 2, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(testReaderString), 3, 2, func(b *Chunk) error {
 		assert.Equal(t, testChunkedString[index], string(b.Bytes))
 		index += 1
 		return nil
@@ -88,7 +89,7 @@ func TestChunkedProcessorChunkingSuccess(t *testing.T) {
 
 func TestChunkedProcessorEmptySuccess(t *testing.T) {
 	var index int
-	size, err := ChunkedProcessor(strings.NewReader(""), 1, 2, func(b *Chunk) error {
+	size, err := ChunkedProcessor(context.Background(), strings.NewReader(""), 1, 2, func(b *Chunk) error {
 		index += 1
 		return nil
 	})
@@ -96,3 +97,13 @@ func TestChunkedProcessorEmptySuccess(t *testing.T) {
 	assert.Equal(t, int64(0), size)
 	assert.Equal(t, 0, index)
 }
+
+func TestChunkedProcessorCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	size, err := ChunkedProcessor(ctx, strings.NewReader(testReaderString), 1, 2, func(b *Chunk) error {
+		cancel()
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(0), size)
+}
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// RangeFetchFunc retrieves the bytes from begin to end, inclusive, of some
+// content.  It must return exactly end-begin+1 bytes or an error.
+type RangeFetchFunc func(ctx context.Context, begin, end int64) ([]byte, error)
+
+type rangeResult struct {
+	bytes []byte
+	err   error
+}
+
+type rangeReader struct {
+	ctx       context.Context
+	cancel    func()
+	wg        sync.WaitGroup
+	fetch     RangeFetchFunc
+	size      int64
+	ranges    int64
+	chunkSize int64
+	// window holds a token for every range that has been started but not yet
+	// fully read, which bounds the number of ranges held in memory.
+	window chan struct{}
+	// slots holds a token for every range being fetched.
+	slots   chan struct{}
+	results []chan rangeResult
+
+	errLock  sync.Mutex
+	fetchErr error
+
+	next int64
+	buf  []byte
+	err  error
+}
+
+// ParallelRangeReader returns an io.ReadCloser over content of size bytes
+// that is fetched in ranges of chunkSize bytes, with up to parallelism ranges
+// fetched at the same time.
+//
+// Ranges are fetched in order and reassembled in order, so the reader always
+// returns the content sequentially.  A range is held in memory from the time
+// its fetch starts until it has been completely read, and at most maxBuffered
+// ranges are held at once, so memory consumption never exceeds maxBuffered
+// times chunkSize.  The parallelism is reduced to maxBuffered if it is larger.
+//
+// If a fetch fails, the other fetches are stopped and Read returns the error
+// of the first failed fetch.  Fetching also stops when ctx is canceled or the
+// reader is closed; Close waits for fetches in progress to return.
+func ParallelRangeReader(ctx context.Context, size int64, chunkSize int64, parallelism int, maxBuffered int, fetch RangeFetchFunc) io.ReadCloser {
+	if chunkSize <= 0 {
+		chunkSize = size
+	}
+	if maxBuffered < 1 {
+		maxBuffered = 1
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if parallelism > maxBuffered {
+		parallelism = maxBuffered
+	}
+	var ranges int64
+	if size > 0 {
+		ranges = (size + chunkSize - 1) / chunkSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	reader := &rangeReader{
+		ctx:       ctx,
+		cancel:    cancel,
+		fetch:     fetch,
+		size:      size,
+		ranges:    ranges,
+		chunkSize: chunkSize,
+		window:    make(chan struct{}, maxBuffered),
+		slots:     make(chan struct{}, parallelism),
+		results:   make([]chan rangeResult, ranges),
+	}
+	for i := range reader.results {
+		reader.results[i] = make(chan rangeResult, 1)
+	}
+	reader.wg.Add(1)
+	go reader.dispatch()
+	return reader
+}
+
+// dispatch starts fetching each range in order as soon as both the window
+// and the parallelism allow it.
+func (reader *rangeReader) dispatch() {
+	defer reader.wg.Done()
+	for i := int64(0); i < reader.ranges; i++ {
+		select {
+		case reader.window <- struct{}{}:
+		case <-reader.ctx.Done():
+			return
+		}
+		select {
+		case reader.slots <- struct{}{}:
+		case <-reader.ctx.Done():
+			return
+		}
+		begin := i * reader.chunkSize
+		end := begin + reader.chunkSize - 1
+		if end >= reader.size {
+			end = reader.size - 1
+		}
+		reader.wg.Add(1)
+		go func(i, begin, end int64) {
+			defer reader.wg.Done()
+			defer func() { <-reader.slots }()
+			b, err := reader.fetch(reader.ctx, begin, end)
+			if err == nil && int64(len(b)) != end-begin+1 {
+				err = fmt.Errorf("range %d-%d: received %d bytes, expected %d", begin, end, len(b), end-begin+1)
+			}
+			if err != nil {
+				reader.fetchFailed(err)
+			}
+			reader.results[i] <- rangeResult{bytes: b, err: err}
+		}(i, begin, end)
+	}
+}
+
+func (reader *rangeReader) Read(p []byte) (int, error) {
+	for len(reader.buf) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if reader.next >= reader.ranges {
+			reader.err = io.EOF
+			continue
+		}
+		select {
+		case result := <-reader.results[reader.next]:
+			if result.err != nil {
+				reader.fail(result.err)
+				continue
+			}
+			reader.buf = result.bytes
+			reader.next++
+		case <-reader.ctx.Done():
+			reader.fail(reader.ctx.Err())
+		}
+	}
+	n := copy(p, reader.buf)
+	reader.buf = reader.buf[n:]
+	if len(reader.buf) == 0 {
+		// the range has been read completely, so release it
+		reader.buf = nil
+		<-reader.window
+	}
+	return n, nil
+}
+
+// fetchFailed records the first failed fetch and stops the others.
+func (reader *rangeReader) fetchFailed(err error) {
+	reader.errLock.Lock()
+	if reader.fetchErr == nil {
+		reader.fetchErr = err
+	}
+	reader.errLock.Unlock()
+	reader.cancel()
+}
+
+// fail stops reading.  The first failed fetch is reported in place of err, as
+// the fetches canceled because of it fail with the context's error.
+func (reader *rangeReader) fail(err error) {
+	reader.errLock.Lock()
+	if reader.fetchErr != nil {
+		err = reader.fetchErr
+	}
+	reader.errLock.Unlock()
+	reader.err = err
+	reader.cancel()
+}
+
+func (reader *rangeReader) Close() error {
+	reader.cancel()
+	reader.wg.Wait()
+	return nil
+}
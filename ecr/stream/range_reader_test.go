@@ -0,0 +1,130 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fetchString serves ranges of content, delaying each by a random amount so
+// that ranges complete out of order.
+func fetchString(content string) RangeFetchFunc {
+	return func(ctx context.Context, begin, end int64) ([]byte, error) {
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		return []byte(content[begin : end+1]), nil
+	}
+}
+
+func TestParallelRangeReaderSuccess(t *testing.T) {
+	for _, chunkSize := range []int64{1, 2, 3, 7, 10} {
+		reader := ParallelRangeReader(context.Background(), int64(len(testReaderString)), chunkSize, 3, 4, fetchString(testReaderString))
+		body, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, testReaderString, string(body), "chunk size %d", chunkSize)
+		assert.NoError(t, reader.Close())
+	}
+}
+
+func TestParallelRangeReaderEmpty(t *testing.T) {
+	reader := ParallelRangeReader(context.Background(), 0, 1, 3, 3, func(context.Context, int64, int64) ([]byte, error) {
+		t.Fatal("no range should be fetched")
+		return nil, nil
+	})
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Empty(t, body)
+}
+
+func TestParallelRangeReaderMemoryLimit(t *testing.T) {
+	const maxBuffered = 2
+	var (
+		lock    sync.Mutex
+		started int
+	)
+	fetch := fetchString(testReaderString)
+	reader := ParallelRangeReader(context.Background(), int64(len(testReaderString)), 1, 4, maxBuffered,
+		func(ctx context.Context, begin, end int64) ([]byte, error) {
+			lock.Lock()
+			started++
+			lock.Unlock()
+			return fetch(ctx, begin, end)
+		})
+	defer reader.Close()
+
+	p := make([]byte, 1)
+	for consumed := 0; consumed < len(testReaderString); consumed++ {
+		// give the reader a chance to start more ranges than allowed
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		assert.True(t, started <= consumed+maxBuffered, "%d ranges started with %d consumed", started, consumed)
+		lock.Unlock()
+		_, err := io.ReadFull(reader, p)
+		require.NoError(t, err)
+		assert.Equal(t, testReaderString[consumed], p[0])
+	}
+}
+
+func TestParallelRangeReaderFail(t *testing.T) {
+	expected := errors.New("error")
+	reader := ParallelRangeReader(context.Background(), int64(len(testReaderString)), 1, 3, 3,
+		func(ctx context.Context, begin, end int64) ([]byte, error) {
+			if begin == 1 {
+				return nil, expected
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	_, err := ioutil.ReadAll(reader)
+	assert.Equal(t, expected, err)
+	assert.NoError(t, reader.Close())
+}
+
+func TestParallelRangeReaderShortRange(t *testing.T) {
+	reader := ParallelRangeReader(context.Background(), int64(len(testReaderString)), 2, 1, 1,
+		func(ctx context.Context, begin, end int64) ([]byte, error) {
+			return []byte(testReaderString[begin:end]), nil
+		})
+	_, err := ioutil.ReadAll(reader)
+	assert.Error(t, err)
+	assert.NoError(t, reader.Close())
+}
+
+func TestParallelRangeReaderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fetching := make(chan struct{}, len(testReaderString))
+	reader := ParallelRangeReader(ctx, int64(len(testReaderString)), 1, 2, 2,
+		func(ctx context.Context, begin, end int64) ([]byte, error) {
+			fetching <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	<-fetching
+	cancel()
+	_, err := ioutil.ReadAll(reader)
+	assert.Equal(t, context.Canceled, err)
+	// Close waits for the fetches to return
+	assert.NoError(t, reader.Close())
+}
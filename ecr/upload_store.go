@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// UploadState is the state of an in-progress layer upload to Amazon ECR.  It
+// is recorded after every part that Amazon ECR acknowledges so that the
+// upload can be continued by another process.
+type UploadState struct {
+	// Registry is the ID of the registry the layer is being uploaded to.
+	Registry string `json:"registry"`
+	// Repository is the name of the repository the layer is being uploaded
+	// to.
+	Repository string `json:"repository"`
+	// Digest is the expected digest of the layer.
+	Digest digest.Digest `json:"digest"`
+	// UploadID is the upload ID returned by InitiateLayerUpload.
+	UploadID string `json:"uploadID"`
+	// PartSize is the part size returned by InitiateLayerUpload.
+	PartSize int64 `json:"partSize"`
+	// Offset is the number of bytes acknowledged by Amazon ECR.  The next
+	// part starts at Offset.
+	Offset int64 `json:"offset"`
+	// DigestState is the marshaled state of the hash of the first Offset
+	// bytes of the layer.
+	DigestState []byte `json:"digestState,omitempty"`
+	// UpdatedAt is the time the state was last recorded.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// UploadStore persists the state of in-progress layer uploads.  Get returns
+// an error satisfying errdefs.IsNotFound when there is no state for the key.
+type UploadStore interface {
+	Get(key string) (UploadState, error)
+	Put(key string, state UploadState) error
+	Delete(key string) error
+}
+
+// uploadKey returns the key identifying an upload of the layer dgst to the
+// repository described by ecrSpec.
+func uploadKey(ecrSpec ECRSpec, dgst digest.Digest) string {
+	return ecrSpec.Registry() + "/" + ecrSpec.Repository + "@" + dgst.String()
+}
+
+type fileUploadStore struct {
+	root string
+	lock sync.Mutex
+}
+
+// NewFileUploadStore returns an UploadStore that keeps the state of each
+// upload in a file under the root directory, creating the directory if
+// necessary.  The store can be shared by multiple resolvers in the same
+// process.
+func NewFileUploadStore(root string) (UploadStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, errors.Wrap(err, "ecr.upload.store: failed to create directory")
+	}
+	return &fileUploadStore{root: root}, nil
+}
+
+// path returns the file used for key.  Keys contain characters that are not
+// safe in file names, so the file is named after the digest of the key.
+func (s *fileUploadStore) path(key string) string {
+	return filepath.Join(s.root, digest.FromString(key).Hex()+".json")
+}
+
+func (s *fileUploadStore) Get(key string) (UploadState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var state UploadState
+	b, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, errors.Wrapf(errdefs.ErrNotFound, "upload state for %v", key)
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, errors.Wrapf(err, "ecr.upload.store: invalid upload state for %v", key)
+	}
+	return state, nil
+}
+
+func (s *fileUploadStore) Put(key string, state UploadState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it so that a crash never leaves
+	// a partially written state behind
+	path := s.path(key)
+	f, err := ioutil.TempFile(s.root, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *fileUploadStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileUploadStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecr-upload-store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileUploadStore(dir)
+	require.NoError(t, err)
+
+	key := "registry/repository@" + digest.FromString("layer").String()
+	_, err = store.Get(key)
+	assert.True(t, errdefs.IsNotFound(err), "missing state should be not found: %v", err)
+
+	state := UploadState{
+		Registry:    "registry",
+		Repository:  "repository",
+		Digest:      digest.FromString("layer"),
+		UploadID:    "upload",
+		PartSize:    5,
+		Offset:      10,
+		DigestState: []byte("state"),
+		UpdatedAt:   time.Now().UTC().Truncate(time.Second),
+	}
+	require.NoError(t, store.Put(key, state))
+
+	// a new store over the same directory sees the state
+	store, err = NewFileUploadStore(dir)
+	require.NoError(t, err)
+	loaded, err := store.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	require.NoError(t, store.Delete(key))
+	_, err = store.Get(key)
+	assert.True(t, errdefs.IsNotFound(err), "deleted state should be not found: %v", err)
+	assert.NoError(t, store.Delete(key), "deleting missing state should succeed")
+}
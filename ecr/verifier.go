@@ -0,0 +1,177 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Verifier verifies an image before it is returned by Resolve.  Verify
+// receives the spec of the resolved ref, the descriptor of its manifest, and
+// the manifest itself.  If Verify returns an error, Resolve fails with that
+// error and the image is not pulled.
+type Verifier interface {
+	Verify(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error
+}
+
+// VerifierFunc is an adapter to use an ordinary function as a Verifier.
+type VerifierFunc func(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error
+
+// Verify calls f(ctx, spec, desc, manifest).
+func (f VerifierFunc) Verify(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+	return f(ctx, spec, desc, manifest)
+}
+
+const (
+	// SignatureArtifactType is the artifact type of the detached signatures
+	// checked by the Verifier returned by NewSignatureVerifier.
+	SignatureArtifactType = "application/vnd.amazon.ecr.containerd-resolver.signature.v1"
+	// SignatureAnnotation is the manifest annotation holding a detached
+	// signature.  Its value is the base64 encoding of a signature of the
+	// subject's digest string, such as "sha256:...", made with SHA-256 and
+	// either RSA PKCS #1 v1.5 or ECDSA in ASN.1 form.
+	SignatureAnnotation = "com.amazonaws.ecr.containerd-resolver.signature"
+
+	// verifierScanLimit is the number of untagged images scanned for a
+	// signature when none is found in the referrers index or the cosign tags.
+	verifierScanLimit = 100
+)
+
+type signatureVerifier struct {
+	lister    ReferrersLister
+	publicKey crypto.PublicKey
+}
+
+// NewSignatureVerifier returns a Verifier that requires an image to have a
+// detached signature made by the private key of publicKey.  Signatures are
+// stored as referrers of the image manifest with the artifact type
+// SignatureArtifactType, and the signature itself in the SignatureAnnotation
+// of the referrer manifest.  Referrers are listed with lister, which is
+// usually a resolver created by NewResolver without a verifier.  Since images
+// are verified on every Resolve, such a resolver looks for signatures in the
+// referrers index and the cosign tags first, and only if no valid signature is
+// found there does it scan up to 100 untagged images of the repository, which
+// finds signatures whose index update was lost.  In repositories with more
+// untagged images, such signatures may not be found.  Amazon ECR Public has no
+// referrers, so the verifier rejects every public image.  Public keys can be
+// read from PEM files with x509.ParsePKIXPublicKey; RSA and ECDSA keys are
+// supported.
+func NewSignatureVerifier(lister ReferrersLister, publicKey crypto.PublicKey) (Verifier, error) {
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, errors.Errorf("unsupported public key type %T", publicKey)
+	}
+	return &signatureVerifier{lister: lister, publicKey: publicKey}, nil
+}
+
+func (v *signatureVerifier) Verify(ctx context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.verifier: invalid digest %q: %v", desc.Digest, err)
+	}
+	// the signature covers the digest, so make sure it describes the manifest
+	if actual := desc.Digest.Algorithm().FromBytes(manifest); actual != desc.Digest {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.verifier: manifest digest %v does not match %v", actual, desc.Digest)
+	}
+	if spec.Public() {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "ecr.verifier: signatures of Amazon ECR Public image %v cannot be verified", desc.Digest)
+	}
+	// the image URI keeps the FIPS, dual-stack, or VPC endpoint of the ref,
+	// which the canonical ARN form does not
+	ref := spec.ImageURI()
+	lister, bounded := v.lister.(boundedReferrersLister)
+	list := v.lister.Referrers
+	if bounded {
+		list = lister.taggedReferrers
+	}
+	referrers, err := list(ctx, ref, desc.Digest, SignatureArtifactType)
+	if err != nil {
+		return errors.Wrap(err, "ecr.verifier: failed to list signatures")
+	}
+	if v.verifyReferrers(ctx, desc.Digest, referrers) {
+		return nil
+	}
+	if bounded {
+		// updates of the referrers index are best-effort, so look for
+		// signatures that were pushed without being recorded in it
+		log.G(ctx).WithField("digest", desc.Digest).Debug("ecr.verifier: scanning untagged images for signatures")
+		referrers, err := lister.scannedReferrers(ctx, ref, desc.Digest, SignatureArtifactType, verifierScanLimit)
+		if err != nil {
+			return errors.Wrap(err, "ecr.verifier: failed to list signatures")
+		}
+		if v.verifyReferrers(ctx, desc.Digest, referrers) {
+			return nil
+		}
+	}
+	return errors.Wrapf(errdefs.ErrFailedPrecondition, "ecr.verifier: no valid signature for %v", desc.Digest)
+}
+
+// verifyReferrers reports whether any of referrers holds a valid signature of
+// dgst.
+func (v *signatureVerifier) verifyReferrers(ctx context.Context, dgst digest.Digest, referrers []Referrer) bool {
+	for _, referrer := range referrers {
+		encoded, ok := referrer.Annotations[SignatureAnnotation]
+		if !ok {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			log.G(ctx).
+				WithError(err).
+				WithField("signature", referrer.Digest).
+				Warn("ecr.verifier: invalid signature encoding")
+			continue
+		}
+		if v.verifySignature(dgst, signature) {
+			log.G(ctx).
+				WithField("signature", referrer.Digest).
+				Debug("ecr.verifier: verified signature")
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature reports whether signature is a valid signature of dgst.
+func (v *signatureVerifier) verifySignature(dgst digest.Digest, signature []byte) bool {
+	hashed := sha256.Sum256([]byte(dgst.String()))
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature) == nil
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+			return false
+		}
+		return ecdsa.Verify(key, hashed[:], sig.R, sig.S)
+	}
+	return false
+}
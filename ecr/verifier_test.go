@@ -0,0 +1,285 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveVerifier(t *testing.T) {
+	ref := "ecr.aws/arn:aws:ecr:fake:123456789012:repository/foo/bar:latest"
+	imageManifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`
+	imageDigest := digest.FromString(imageManifest)
+	fakeClient := &fakeECRClient{
+		BatchGetImageFn: func(aws.Context, *ecr.BatchGetImageInput, ...request.Option) (*ecr.BatchGetImageOutput, error) {
+			return &ecr.BatchGetImageOutput{Images: []*ecr.Image{{
+				ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(imageDigest.String())},
+				ImageManifest: aws.String(imageManifest),
+			}}}, nil
+		},
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{"accepted", nil},
+		{"rejected", errors.New("rejected")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			resolver := &ecrResolver{
+				clients: map[string]ECRClient{
+					"fake": fakeClient,
+				},
+				verifier: VerifierFunc(func(_ context.Context, spec ECRSpec, desc ocispec.Descriptor, manifest []byte) error {
+					calls++
+					assert.Equal(t, "foo/bar", spec.Repository)
+					assert.Equal(t, imageDigest, desc.Digest)
+					assert.Equal(t, imageManifest, string(manifest))
+					return tc.err
+				}),
+			}
+			_, desc, err := resolver.Resolve(context.Background(), ref)
+			assert.Equal(t, 1, calls, "the verifier should be called once")
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				assert.Equal(t, ocispec.Descriptor{}, desc)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, imageDigest, desc.Digest)
+			}
+		})
+	}
+}
+
+// fakeReferrersLister is a ReferrersLister backed by a function.
+type fakeReferrersLister func(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error)
+
+func (f fakeReferrersLister) Referrers(ctx context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	return f(ctx, ref, subject, artifactType)
+}
+
+// signatureReferrer returns a signature referrer holding signature.
+func signatureReferrer(signature []byte) Referrer {
+	return Referrer{
+		Descriptor: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromBytes(signature),
+			Annotations: map[string]string{
+				SignatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+			},
+		},
+		ArtifactType: SignatureArtifactType,
+	}
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	hashed := sha256.Sum256([]byte(desc.Digest.String()))
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, hashed[:])
+	require.NoError(t, err)
+	ecdsaSignature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSignature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hashed[:])
+	require.NoError(t, err)
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name      string
+		publicKey crypto.PublicKey
+		referrers []Referrer
+		manifest  []byte
+		valid     bool
+	}{
+		{"ecdsa", &ecdsaKey.PublicKey, []Referrer{signatureReferrer(ecdsaSignature)}, manifest, true},
+		{"rsa", &rsaKey.PublicKey, []Referrer{signatureReferrer(rsaSignature)}, manifest, true},
+		{"one of several", &rsaKey.PublicKey, []Referrer{signatureReferrer(ecdsaSignature), signatureReferrer(rsaSignature)}, manifest, true},
+		{"wrong key", &otherKey.PublicKey, []Referrer{signatureReferrer(ecdsaSignature)}, manifest, false},
+		{"unsigned", &ecdsaKey.PublicKey, nil, manifest, false},
+		{"tampered manifest", &ecdsaKey.PublicKey, []Referrer{signatureReferrer(ecdsaSignature)}, []byte("tampered"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lister := fakeReferrersLister(func(_ context.Context, ref string, subject digest.Digest, artifactType string) ([]Referrer, error) {
+				assert.Equal(t, desc.Digest, subject)
+				assert.Equal(t, SignatureArtifactType, artifactType)
+				return tc.referrers, nil
+			})
+			verifier, err := NewSignatureVerifier(lister, tc.publicKey)
+			require.NoError(t, err)
+			err = verifier.Verify(context.Background(), ECRSpec{Repository: "foo/bar"}, desc, tc.manifest)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errdefs.IsFailedPrecondition(err), "verification should fail: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewSignatureVerifierUnsupportedKey(t *testing.T) {
+	_, err := NewSignatureVerifier(fakeReferrersLister(nil), "not a key")
+	assert.Error(t, err)
+}
+
+func TestSignatureVerifierScan(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	hashed := sha256.Sum256([]byte(desc.Digest.String()))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hashed[:])
+	require.NoError(t, err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+	referrer := signatureReferrer(signature)
+	signatureManifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ocispec.MediaTypeImageManifest,
+		"artifactType":  SignatureArtifactType,
+		"config":        ocispec.Descriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: digest.FromString("{}"), Size: 2},
+		"layers":        []ocispec.Descriptor{},
+		"subject":       desc,
+		"annotations":   referrer.Annotations,
+	})
+	require.NoError(t, err)
+
+	store := &fakeImageStore{manifests: map[string]string{}}
+	client := store.client()
+	var untagged []*ecr.ImageDetail
+	describeCalls := 0
+	client.DescribeImagesFn = func(_ aws.Context, input *ecr.DescribeImagesInput, _ ...request.Option) (*ecr.DescribeImagesOutput, error) {
+		describeCalls++
+		assert.Equal(t, int64(verifierScanLimit), aws.Int64Value(input.MaxResults), "the scan should be bounded")
+		return &ecr.DescribeImagesOutput{ImageDetails: untagged}, nil
+	}
+	lister := &ecrResolver{
+		clients: map[string]ECRClient{
+			"us-west-2": client,
+		},
+	}
+	verifier, err := NewSignatureVerifier(lister, &key.PublicKey)
+	require.NoError(t, err)
+	spec, err := ParseRef("ecr.aws/arn:aws:ecr:us-west-2:123456789012:repository/foo/bar:latest")
+	require.NoError(t, err)
+
+	// without a signature, the untagged images are scanned
+	err = verifier.Verify(context.Background(), spec, desc, manifest)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "verification should fail: %v", err)
+	assert.Equal(t, 1, describeCalls)
+
+	// a signature missing from the referrers index is found by the scan
+	signatureDigest := store.add("", string(signatureManifest))
+	untagged = []*ecr.ImageDetail{{ImageDigest: aws.String(signatureDigest.String())}}
+	describeCalls = 0
+	err = verifier.Verify(context.Background(), spec, desc, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, describeCalls)
+
+	// a signature tagged by cosign is found without scanning
+	store.add("sha256-"+desc.Digest.Hex()+".sig", string(signatureManifest))
+	describeCalls = 0
+	err = verifier.Verify(context.Background(), spec, desc, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, describeCalls, "the untagged images should not be scanned")
+}
+
+func TestSignatureVerifierPublic(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	lister := fakeReferrersLister(func(context.Context, string, digest.Digest, string) ([]Referrer, error) {
+		t.Error("referrers of public images should not be listed")
+		return nil, nil
+	})
+	verifier, err := NewSignatureVerifier(lister, &key.PublicKey)
+	require.NoError(t, err)
+	spec, err := ParseRef("public.ecr.aws/alias/repo:latest")
+	require.NoError(t, err)
+
+	err = verifier.Verify(context.Background(), spec, desc, manifest)
+	assert.True(t, errdefs.IsNotImplemented(err), "public images cannot be verified: %v", err)
+}
+
+func TestSignatureVerifierEndpoint(t *testing.T) {
+	const ref = "123456789012.dkr.ecr-fips.us-west-2.amazonaws.com/foo/bar:latest"
+	manifest := []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json"}`)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	listed := false
+	lister := fakeReferrersLister(func(_ context.Context, listRef string, _ digest.Digest, _ string) ([]Referrer, error) {
+		listed = true
+		// signatures are listed through the endpoint named by the ref
+		assert.Equal(t, ref, listRef)
+		return nil, nil
+	})
+	verifier, err := NewSignatureVerifier(lister, &key.PublicKey)
+	require.NoError(t, err)
+	spec, err := ParseRef(ref)
+	require.NoError(t, err)
+
+	err = verifier.Verify(context.Background(), spec, desc, manifest)
+	assert.True(t, errdefs.IsFailedPrecondition(err), "verification should fail without signatures: %v", err)
+	assert.True(t, listed, "signatures should be listed")
+}
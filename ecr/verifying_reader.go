@@ -0,0 +1,86 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package ecr
+
+import (
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// verifyingReader is an io.ReadCloser that checks the content read from it
+// against the size and digest of a descriptor.  A mismatch is returned as an
+// error in place of io.EOF, so consumers never see unverified content end
+// successfully.
+type verifyingReader struct {
+	rc       io.ReadCloser
+	desc     ocispec.Descriptor
+	verifier digest.Verifier
+	n        int64
+	err      error
+}
+
+// newVerifyingReader returns a reader verifying the content of rc against
+// desc.  The size is only checked when desc.Size is set.
+func newVerifyingReader(rc io.ReadCloser, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		rc.Close()
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "ecr.fetcher: invalid digest %q: %v", desc.Digest, err)
+	}
+	return &verifyingReader{
+		rc:       rc,
+		desc:     desc,
+		verifier: desc.Digest.Verifier(),
+	}, nil
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.rc.Read(p)
+	if vr.desc.Size > 0 && vr.n+int64(n) > vr.desc.Size {
+		// Only return the content up to the expected size.
+		n = int(vr.desc.Size - vr.n)
+		vr.n = vr.desc.Size
+		vr.err = errors.Wrapf(errdefs.ErrFailedPrecondition,
+			"ecr.fetcher: content exceeds expected size %d", vr.desc.Size)
+		return n, vr.err
+	}
+	vr.n += int64(n)
+	vr.verifier.Write(p[:n])
+	if err == io.EOF {
+		switch {
+		case vr.desc.Size > 0 && vr.n != vr.desc.Size:
+			err = errors.Wrapf(errdefs.ErrFailedPrecondition,
+				"ecr.fetcher: unexpected size %d, expected %d", vr.n, vr.desc.Size)
+		case !vr.verifier.Verified():
+			err = errors.Wrapf(errdefs.ErrFailedPrecondition,
+				"ecr.fetcher: content does not match digest %v", vr.desc.Digest)
+		}
+	}
+	if err != nil {
+		vr.err = err
+	}
+	return n, err
+}
+
+func (vr *verifyingReader) Close() error {
+	return vr.rc.Close()
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You
+ * may not use this file except in compliance with the License. A copy of
+ * the License is located at
+ *
+ * 	http://aws.amazon.com/apache2.0/
+ *
+ * or in the "license" file accompanying this file. This file is
+ * distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF
+ * ANY KIND, either express or implied. See the License for the specific
+ * language governing permissions and limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/awslabs/amazon-ecr-containerd-resolver/ecr"
+	"github.com/containerd/containerd/log"
+)
+
+func main() {
+	ctx := context.Background()
+
+	if len(os.Args) < 2 {
+		log.G(ctx).Fatal("Must provide lockfile and refs to pin as arguments")
+	}
+	path := os.Args[1]
+	refs := os.Args[2:]
+
+	lockfile, err := ecr.LoadLockfile(path)
+	if os.IsNotExist(err) {
+		lockfile = &ecr.Lockfile{}
+	} else if err != nil {
+		log.G(ctx).WithError(err).WithField("lockfile", path).Fatal("Failed to load lockfile")
+	}
+	// without refs, refresh every ref already in the lockfile
+	if len(refs) == 0 {
+		for ref := range lockfile.Images {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+	}
+	if len(refs) == 0 {
+		log.G(ctx).WithField("lockfile", path).Fatal("No refs to pin")
+	}
+
+	resolver, err := ecr.NewResolver()
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
+	}
+
+	for _, ref := range refs {
+		_, desc, err := resolver.Resolve(ctx, ref)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("ref", ref).Fatal("Failed to resolve")
+		}
+		if err := lockfile.Pin(ref, desc.Digest); err != nil {
+			log.G(ctx).WithError(err).WithField("ref", ref).Fatal("Failed to pin")
+		}
+		log.G(ctx).WithField("ref", ref).WithField("digest", desc.Digest).Info("Pinned")
+	}
+
+	if err := lockfile.Save(path); err != nil {
+		log.G(ctx).WithError(err).WithField("lockfile", path).Fatal("Failed to save lockfile")
+	}
+	log.G(ctx).WithField("lockfile", path).Info("Saved lockfile")
+}
@@ -77,6 +77,13 @@ func main() {
 	if err != nil {
 		log.G(ctx).WithError(err).Fatal("Failed to create resolver")
 	}
+	if lockfilePath := os.Getenv("ECR_PULL_LOCKFILE"); lockfilePath != "" {
+		lockfile, err := ecr.LoadLockfile(lockfilePath)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("Failed to load ECR_PULL_LOCKFILE")
+		}
+		resolver = ecr.NewLockedResolver(resolver, lockfile)
+	}
 
 	log.G(ctx).WithField("ref", ref).Info("Pulling from Amazon ECR")
 	img, err := client.Pull(ctx, ref,
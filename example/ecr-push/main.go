@@ -80,7 +80,8 @@ func main() {
 
 		return client.Push(ctx, ref, desc,
 			containerd.WithResolver(resolver),
-			containerd.WithImageHandler(jobHandler))
+			containerd.WithImageHandler(jobHandler),
+			containerd.WithImageHandler(ecr.PushHandler(resolver, ref, client.ContentStore())))
 
 	})
 	errs := make(chan error)